@@ -0,0 +1,81 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// adoptPoll is the interval at which an adopted process is checked for exit
+const adoptPoll = 100 * time.Millisecond
+
+// Adopt - wraps an already running process in a CmdIo so it can be managed
+// with Terminate, Info and Join. The process is not a child of this process
+// so its exit is detected by polling, the exit code and signal can not be
+// observed and are reported as -1 and 0, Signaled is only set when the
+// process was signaled through the CmdIo
+func Adopt(pid int) (*CmdIo, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("adopt pid %d: %w", pid, syscall.ESRCH)
+	}
+	if e := kill(pid, 0); e != nil && e != syscall.EPERM {
+		return nil, fmt.Errorf("adopt pid %d: %w", pid, e)
+	}
+	pgid, e := getpgid(pid)
+	if e != nil {
+		return nil, fmt.Errorf("adopt pid %d: %w", pid, e)
+	}
+	start, e := procStart(pid)
+	if e != nil {
+		return nil, fmt.Errorf("adopt pid %d: %w", pid, e)
+	}
+
+	c := New(func() *Options { return &Options{} })
+	c.ini.Do(func() {
+		c.lok.Lock()
+		c.ran = true
+		c.inf.Pid = pid
+		c.inf.Pgid = pgid
+		c.inf.StartT = start.UnixNano()
+		c.inf.Attempts = 1
+		c.pgd = pgid
+		// start has no monotonic reading, anchor it to one
+		c.str = time.Now().Add(-time.Since(start))
+		c.sta = Running
+		c.lok.Unlock()
+
+		c.evh.publish(StartedEvent{At: start, Pid: pid, Attempt: 1})
+		c.started(StartResult{Pid: pid, StartedAt: start})
+		go c.adoptFn(pid, start)
+	})
+	return c, nil
+}
+
+func (c *CmdIo) adoptFn(pid int, start time.Time) {
+	defer c.finish()
+
+	t := time.NewTicker(adoptPoll)
+	defer t.Stop()
+	for range t.C {
+		if kill(pid, 0) == syscall.ESRCH {
+			break
+		}
+	}
+	c.endState(&start, -1, 0, nil, true)
+}
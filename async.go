@@ -0,0 +1,129 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// QueuePolicy - what an AsyncOutput queue does when it is full
+type QueuePolicy int
+
+const (
+	// Block - blocks the command until the queue has room
+	Block QueuePolicy = iota
+	// DropOldest - drops the oldest queued output
+	DropOldest
+	// DropNewest - drops the output that does not fit
+	DropNewest
+)
+
+// AsyncOutput - decouples Out, Err and the additional writers from the
+// command through a bounded queue, so a slow writer does not stall it
+type AsyncOutput struct {
+	// Size - the number of writes the queue holds, 64 by default
+	Size   int
+	Policy QueuePolicy
+}
+
+// asyncWriter writes to w from its own goroutine
+type asyncWriter struct {
+	w    io.Writer
+	max  int
+	pol  QueuePolicy
+	drp  *int64
+	fail func(error)
+	lok  sync.Mutex
+	cnd  *sync.Cond
+	que  [][]byte
+	end  bool
+	fin  chan struct{}
+}
+
+func newAsyncWriter(w io.Writer, opt *AsyncOutput, drp *int64, fail func(error)) *asyncWriter {
+	a := &asyncWriter{w: w, max: opt.Size, pol: opt.Policy, drp: drp, fail: fail, fin: make(chan struct{})}
+	if a.max <= 0 {
+		a.max = 64
+	}
+	a.cnd = sync.NewCond(&a.lok)
+	go a.loop()
+	return a
+}
+
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	a.lok.Lock()
+	defer a.lok.Unlock()
+
+	for a.pol == Block && len(a.que) >= a.max && !a.end {
+		a.cnd.Wait()
+	}
+	if len(a.que) >= a.max {
+		if a.pol == DropNewest {
+			atomic.AddInt64(a.drp, int64(len(p)))
+			return len(p), nil
+		}
+		atomic.AddInt64(a.drp, int64(len(a.que[0])))
+		a.que = a.que[1:]
+	}
+	a.que = append(a.que, append([]byte(nil), p...))
+	a.cnd.Broadcast()
+	return len(p), nil
+}
+
+func (a *asyncWriter) loop() {
+	defer close(a.fin)
+	for {
+		a.lok.Lock()
+		for len(a.que) == 0 && !a.end {
+			a.cnd.Wait()
+		}
+		que, end := a.que, a.end
+		a.que = nil
+		a.cnd.Broadcast()
+		a.lok.Unlock()
+
+		for _, p := range que {
+			if _, e := a.w.Write(p); e != nil {
+				a.fail(e)
+			}
+		}
+		if end && len(que) == 0 {
+			return
+		}
+	}
+}
+
+// flush waits until everything queued has been written
+func (a *asyncWriter) flush() {
+	a.lok.Lock()
+	a.end = true
+	a.cnd.Broadcast()
+	a.lok.Unlock()
+
+	<-a.fin
+}
+
+func (c *CmdIo) async(w io.Writer) io.Writer {
+	if c.opt.AsyncOutput == nil {
+		return w
+	}
+	a := newAsyncWriter(w, c.opt.AsyncOutput, &c.dpb, c.writeFailed)
+	c.flushOnExit(a)
+	return a
+}
@@ -0,0 +1,135 @@
+//go:build freebsd || openbsd || netbsd || dragonfly
+// +build freebsd openbsd netbsd dragonfly
+
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// maxRSSUnit is the unit of ru_maxrss, kilobytes
+const maxRSSUnit = 1024
+
+func syscallAttrs(cred *credential, opt *Options) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Credential: cred,
+		Setsid:     opt.ProcessGroup == Session,
+		Setpgid:    opt.ProcessGroup == NewGroup,
+		Chroot:     opt.Chroot,
+	}
+}
+
+// procStart is not available on the bsds, Adopt is not supported
+func procStart(pid int) (time.Time, error) {
+	return time.Time{}, ErrUnsupported
+}
+
+func procCPU(pid int) (time.Duration, error) {
+	return 0, ErrUnsupported
+}
+
+// startLimited - rlimits can only be set on this process here, where they
+// would limit all of it, Options.Rlimits is linux only
+func startLimited(cmd *exec.Cmd, limits map[int]Rlimit) error {
+	return ErrUnsupported
+}
+
+// supported rejects the options that are not supported on the bsds
+func supported(opt *Options) error {
+	if opt.MaxCPUTime > 0 {
+		return fmt.Errorf("MaxCPUTime: %w", ErrUnsupported)
+	}
+	if len(opt.CPUSet) > 0 {
+		return fmt.Errorf("CPUSet: %w", ErrUnsupported)
+	}
+	if opt.OOMScoreAdj != nil {
+		return fmt.Errorf("OOMScoreAdj: %w", ErrUnsupported)
+	}
+	if opt.Unshare != (Unshare{}) {
+		return fmt.Errorf("Unshare: %w", ErrUnsupported)
+	}
+	if opt.CgroupPath != "" {
+		return fmt.Errorf("CgroupPath: %w", ErrUnsupported)
+	}
+	if len(opt.AmbientCaps) > 0 {
+		return fmt.Errorf("AmbientCaps: %w", ErrUnsupported)
+	}
+	if len(opt.DropCaps) > 0 {
+		return fmt.Errorf("DropCaps: %w", ErrUnsupported)
+	}
+	if opt.NoNewPrivs {
+		return fmt.Errorf("NoNewPrivs: %w", ErrUnsupported)
+	}
+	if len(opt.Rlimits) > 0 {
+		return fmt.Errorf("Rlimits: %w", ErrUnsupported)
+	}
+	return nil
+}
+
+func confine(opt *Options) error {
+	return nil
+}
+
+// waitIO - the storage io of a command is reported on linux only
+func waitIO(pid int) (read, write int64) {
+	return 0, 0
+}
+
+func setAffinity(pid int, cpus []int) error {
+	return ErrUnsupported
+}
+
+func setOOMScoreAdj(pid, adj int) error {
+	return ErrUnsupported
+}
+
+// cgroup is linux only
+type cgroup struct {
+	dir string
+}
+
+func newCgroup(opt *Options) (*cgroup, error) {
+	return nil, ErrUnsupported
+}
+
+func (cg *cgroup) attrs(attrs *syscall.SysProcAttr) {}
+func (cg *cgroup) closeFD()                         {}
+func (cg *cgroup) signal(sig syscall.Signal)        {}
+func (cg *cgroup) kill()                            {}
+func (cg *cgroup) remove() error                    { return nil }
+
+// killChildren signals the process group of each child of ppid, or the
+// child itself when it is not a group leader, where the children are not
+// known only the process group of a command is signaled
+func killChildren(ppid int, s syscall.Signal) {
+	ch, e := children(ppid)
+	if e == nil {
+		for _, pid := range ch {
+			if _, ok := detached.Load(pid); ok {
+				continue
+			}
+			if kill(-pid, s) == syscall.ESRCH {
+				_ = kill(pid, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroup is the cgroup v2 a command is started in
+type cgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// cgroupRoot returns the mount point of the cgroup v2 hierarchy, empty
+// when it is not mounted
+func cgroupRoot() string {
+	f, e := os.Open("/proc/self/mountinfo")
+	if e != nil {
+		return ""
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		for i := 5; i < len(fields)-1; i++ {
+			if fields[i] == "-" && fields[i+1] == "cgroup2" {
+				return fields[4]
+			}
+		}
+	}
+	return ""
+}
+
+// newCgroup creates Options.CgroupPath with its limits and fails when it
+// exists, it returns nil when cgroup v2 is not mounted
+func newCgroup(opt *Options) (*cgroup, error) {
+	root := cgroupRoot()
+	if root == "" {
+		return nil, nil
+	}
+	dir := filepath.Join(root, opt.CgroupPath)
+	if !strings.HasPrefix(dir, root+"/") {
+		return nil, fmt.Errorf("cgroup %s: %w", opt.CgroupPath, syscall.EINVAL)
+	}
+	if e := os.MkdirAll(filepath.Dir(dir), 0755); e != nil {
+		return nil, fmt.Errorf("cgroup: %w", e)
+	}
+	// a cgroup that already exists belongs to someone else, it must not be
+	// killed and removed with the command
+	if e := os.Mkdir(dir, 0755); e != nil {
+		return nil, fmt.Errorf("cgroup: %w", e)
+	}
+	cg := &cgroup{dir: dir}
+
+	limits := map[string]string{}
+	if opt.CgroupMemoryMax > 0 {
+		limits["memory"] = strconv.FormatInt(opt.CgroupMemoryMax, 10)
+	}
+	if opt.CgroupCPUMax != "" {
+		limits["cpu"] = opt.CgroupCPUMax
+	}
+	for ctl, v := range limits {
+		// the controller must be enabled by every ancestor
+		p := root
+		for _, name := range strings.Split(strings.TrimPrefix(dir, root+"/"), "/") {
+			_ = os.WriteFile(filepath.Join(p, "cgroup.subtree_control"), []byte("+"+ctl), 0)
+			p = filepath.Join(p, name)
+		}
+		if e := os.WriteFile(filepath.Join(dir, ctl+".max"), []byte(v), 0); e != nil {
+			_ = cg.remove()
+			return nil, fmt.Errorf("cgroup %s.max: %w", ctl, e)
+		}
+	}
+
+	fd, e := os.Open(dir)
+	if e != nil {
+		_ = cg.remove()
+		return nil, fmt.Errorf("cgroup: %w", e)
+	}
+	cg.fd = fd
+	return cg, nil
+}
+
+// attrs starts the command in the cgroup with CLONE_INTO_CGROUP
+func (cg *cgroup) attrs(attrs *syscall.SysProcAttr) {
+	attrs.UseCgroupFD = true
+	attrs.CgroupFD = int(cg.fd.Fd())
+}
+
+func (cg *cgroup) closeFD() {
+	if cg.fd != nil {
+		_ = cg.fd.Close()
+		cg.fd = nil
+	}
+}
+
+func (cg *cgroup) procs() []int {
+	b, e := os.ReadFile(filepath.Join(cg.dir, "cgroup.procs"))
+	if e != nil {
+		return nil
+	}
+	var pids []int
+	for _, f := range strings.Fields(string(b)) {
+		if pid, e := strconv.Atoi(f); e == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// signal sends sig to every process of the cgroup, including those that
+// left the process group of the command
+func (cg *cgroup) signal(sig syscall.Signal) {
+	for _, pid := range cg.procs() {
+		_ = kill(pid, sig)
+	}
+}
+
+func (cg *cgroup) kill() {
+	if os.WriteFile(filepath.Join(cg.dir, "cgroup.kill"), []byte("1"), 0) != nil {
+		// cgroup.kill is available from linux 5.14
+		cg.signal(syscall.SIGKILL)
+	}
+}
+
+// remove kills what is left in the cgroup and removes it
+func (cg *cgroup) remove() error {
+	cg.closeFD()
+	if len(cg.procs()) > 0 {
+		cg.kill()
+	}
+	var e error
+	for i := 0; i < 100; i++ {
+		if e = syscall.Rmdir(cg.dir); e != syscall.EBUSY {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return e
+}
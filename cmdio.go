@@ -17,13 +17,22 @@ limitations under the License.
 package cmdio
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/user"
-	"strconv"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -33,118 +42,770 @@ type noCopy struct{}
 func (*noCopy) Lock()   {}
 func (*noCopy) Unlock() {}
 
+var (
+	// ErrTimeout - the command exceeded Options.Timeout
+	ErrTimeout = errors.New("command timed out")
+	// ErrIdleTimeout - the command produced no output for Options.IdleTimeout
+	ErrIdleTimeout = errors.New("command idle timed out")
+	// ErrDeadline - the command did not complete before Options.Deadline
+	ErrDeadline = errors.New("command deadline exceeded")
+	// ErrCPUTime - the command used more than Options.MaxCPUTime
+	ErrCPUTime = errors.New("command cpu time exceeded")
+	// ErrUnsupported - an option is not supported on this platform
+	ErrUnsupported = errors.New("not supported on this platform")
+	// ErrReused - a CmdIo can only be started once, see Reset
+	ErrReused = errors.New("already executed, can not reuse CmdIo")
+	// ErrClosed - the CmdIo has been closed
+	ErrClosed = errors.New("CmdIo is closed")
+	// ErrStarted - the command has already been started
+	ErrStarted = errors.New("command already started")
+	// ErrOptions - the Options are invalid
+	ErrOptions = errors.New("invalid options")
+	// ErrNoCommand - the command name is empty
+	ErrNoCommand = errors.New("command name is empty")
+	// ErrOutputLimit - the command exceeded Options.MaxOutputBytes
+	ErrOutputLimit = errors.New("command output limit exceeded")
+	// ErrNotStarted - the command has not been started
+	ErrNotStarted = errors.New("command not started")
+	// ErrAlreadyFinished - the command has already finished
+	ErrAlreadyFinished = errors.New("command already finished")
+	// ErrWaitTimeout - the command did not exit within the wait timeout
+	ErrWaitTimeout = errors.New("timed out waiting for command to exit")
+	// ErrKilled - the command ignored SIGTERM and was sent SIGKILL
+	ErrKilled = errors.New("command did not exit within the grace period, sent SIGKILL")
+	// ErrStartFailed - the command never ran, matches every *StartError
+	ErrStartFailed = errors.New("command did not start")
+)
+
+// StartError - the error of a command that never ran, Info.Exit is -1,
+// it unwraps to the cause and is ErrStartFailed
+type StartError struct {
+	Err error
+}
+
+func (e *StartError) Error() string {
+	return ErrStartFailed.Error() + ": " + e.Err.Error()
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StartError) Is(target error) bool {
+	return target == ErrStartFailed
+}
+
+// ProcessGroup - where a command is placed, its process group is signaled
+// as a whole unless it inherits the group of this process
+type ProcessGroup int
+
+const (
+	// Session - starts the command in a new session, the default
+	Session ProcessGroup = iota
+	// NewGroup - starts the command in a new process group of this session
+	NewGroup
+	// Inherit - keeps the command in the process group of this process,
+	// signals are sent to the command and its children
+	Inherit
+)
+
+// ExitCodeConvention - how Info.Exit reports a command ended by a signal,
+// Info.Signal holds the signal with every convention
+type ExitCodeConvention int
+
+const (
+	// GoExitCode - -1 like os.ProcessState.ExitCode, the default
+	GoExitCode ExitCodeConvention = iota
+	// RawExitCode - the number of the signal
+	RawExitCode
+	// ShellExitCode - 128 plus the number of the signal, like a shell
+	ShellExitCode
+)
+
+// Unshare - the linux namespaces a command gets of its own
+type Unshare struct {
+	// PID - the command is init of a new pid namespace, all of its
+	// processes are killed when it exits
+	PID bool
+	// Mount - mounts made by the command are not seen by this process
+	Mount bool
+	// Net - the command only has a loopback device
+	Net bool
+	// UTS - the command can set its own hostname
+	UTS bool
+}
+
 type Options struct {
-	In  io.Reader
-	Out io.Writer
-	Err io.Writer
+	In io.Reader
+	// InString - a fixed payload fed to the stdin of the command
+	InString string
+	// InBytes - a fixed payload fed to the stdin of the command, a non nil
+	// empty slice gives the command an immediate EOF
+	InBytes []byte
+	// NoStdin - attaches the null device to the stdin of the command
+	// instead of inheriting os.Stdin
+	NoStdin bool
+	Out     io.Writer
+	Err     io.Writer
+	// Env - replaces the environment of the command when it is not empty,
+	// see Environ
 	Env []string
-	Usr *user.User
+	// EnvAllowlist - inherits only the named variables of this process,
+	// Env is merged over them rather than replacing them
+	EnvAllowlist []string
+	// EnvFile - a dotenv file merged over Env, see EnvFromFile
+	EnvFile string
+	// EnvAppend - KEY=value pairs merged over Env, later keys win
+	EnvAppend []string
+	// EnvMap - variables merged over Env and EnvAppend
+	EnvMap map[string]string
+	Usr    *user.User
+	// Username - the name of the user the command runs as, it is looked up
+	// when the command is started and can not be combined with Usr
+	Username string
+	// Groups - the supplementary groups of the command, those of its user
+	// by default
+	Groups []uint32
+	// NoSetGroups - keeps the supplementary groups of this process
+	NoSetGroups bool
+	// Dir - the working directory of the command inside Chroot, the
+	// working directory of this process, or / with Chroot, by default
+	Dir string
+	// Chroot - the root directory of the command, which is then named by
+	// its path inside the root
+	Chroot  string
+	Timeout time.Duration
+	// IdleTimeout - kills the command when it writes nothing to
+	// stdout or stderr for the duration
+	IdleTimeout time.Duration
+	// MaxCPUTime - kills the command when the user and system time of the
+	// command and its waited children exceeds it
+	MaxCPUTime time.Duration
+	// CPUSampleInterval - how often MaxCPUTime is checked, 250ms by default
+	CPUSampleInterval time.Duration
+	// Deadline - kills the command when the wall clock passes it, time
+	// spent before the command starts counts against the deadline
+	Deadline time.Time
+	// KeepAlive - relaunches the command whenever it exits
+	KeepAlive *KeepAlive
+	// WaitDelay - bounds how long completion waits for the output of a
+	// command once it has exited or been cancelled, 2s by default, a
+	// negative WaitDelay waits for as long as the output is held open,
+	// see exec.Cmd.WaitDelay
+	WaitDelay time.Duration
+	// Nice - the niceness of the command, set right after it starts, a
+	// negative niceness requires root
+	Nice int
+	// CPUSet - pins the command to the cpus, set right after it starts and
+	// before Started delivers, linux only
+	CPUSet []int
+	// OOMScoreAdj - the oom_score_adj of the command, from -1000 to 1000,
+	// set right after it starts, linux only
+	OOMScoreAdj *int
+	// Unshare - isolates the command in new namespaces, linux only, it
+	// requires CAP_SYS_ADMIN. With Unshare.PID the command is terminated
+	// with SIGKILL, init ignores SIGTERM unless it handles it
+	Unshare Unshare
+	// CgroupPath - a cgroup v2 created for the command, relative to the
+	// cgroup2 mount, the command and everything it starts are signaled
+	// through it and it is removed with whatever is left in it once the
+	// command exits. The command fails to start when the cgroup exists.
+	// Without cgroup v2 the command runs as usual, linux only
+	CgroupPath string
+	// CgroupMemoryMax - the memory.max of CgroupPath in bytes
+	CgroupMemoryMax int64
+	// CgroupCPUMax - the cpu.max of CgroupPath, e.g. "50000 100000"
+	CgroupCPUMax string
+	// AmbientCaps - capabilities raised in the ambient set of the command,
+	// e.g. CAP_NET_BIND_SERVICE, so that it keeps them when it runs as
+	// another user, linux only
+	AmbientCaps []string
+	// DropCaps - capabilities dropped from the bounding set of the
+	// command, neither it nor anything it starts can gain them, it
+	// requires CAP_SETPCAP, linux only
+	DropCaps []string
+	// NoNewPrivs - the command and everything it starts can not gain
+	// privileges through setuid binaries or file capabilities, linux only
+	NoNewPrivs bool
+	// Rlimits - resource limits of the command by syscall.RLIMIT_*, they
+	// are applied with prlimit right after it starts, the run fails when a
+	// limit can not be applied, linux only
+	Rlimits map[int]Rlimit
+	// ExtraFiles - files passed to the command as descriptors 3 onwards,
+	// they are not closed by cmdio, see exec.Cmd.ExtraFiles
+	ExtraFiles []*os.File
+	// NamedFiles - files passed after ExtraFiles in the order of their
+	// names, the descriptor of each is set in CMDIO_FD_<name>
+	NamedFiles map[string]*os.File
+	// Umask - the umask of the command, the umask is process wide so it is
+	// changed while the command starts, files created by this process in
+	// the meantime are affected and the starts of all commands are
+	// serialized with it, the umask of this process by default
+	Umask *int
+	// ProcessGroup - the process group of the command, see ProcessGroup
+	ProcessGroup ProcessGroup
+	// ExitCodeConvention - Info.Exit of a command ended by a signal, -1
+	// by default
+	ExitCodeConvention ExitCodeConvention
+	// DeathSignal - sent to the command when this process dies, SIGTERM by
+	// default, linux only
+	DeathSignal syscall.Signal
+	// Detach - starts a command that outlives this process, its stdio is
+	// wired to In/Out/Err when they are files or else the null device, the
+	// command is never waited on so its Info stays unfinished
+	Detach bool
+	// NoTee - stops copying the output written to Out and Err to the
+	// stdout and stderr of this process
+	NoTee bool
+	// Quiet - discards all output and gives the command no stdin,
+	// In, Out and Err are ignored
+	Quiet bool
+	// DropLines - drops lines instead of blocking the command when a
+	// channel returned by Lines or ErrLines is full
+	DropLines bool
+	// OutWriters - additional writers for stdout, a failing writer is
+	// skipped and its error reported in Info.WriteError
+	OutWriters []io.Writer
+	// ErrWriters - additional writers for stderr, see OutWriters
+	ErrWriters []io.Writer
+	// OnStdoutLine - called with every line the command writes to stdout,
+	// on a dedicated goroutine, all calls complete before the final Info
+	// is delivered
+	OnStdoutLine func(string)
+	// OnStderrLine - called with every line the command writes to stderr,
+	// see OnStdoutLine
+	OnStderrLine func(string)
+	// Prefix - written before every line of output
+	Prefix string
+	// PrefixColor - the ANSI SGR color code of Prefix, e.g. 32 for green
+	PrefixColor int
+	// SplitFunc - splits the output into the lines used by the line
+	// callbacks, Lines, the tail, prefixes and timestamps, bufio.ScanLines
+	// by default
+	SplitFunc bufio.SplitFunc
+	// MaxLineBytes - the size at which a line without a delimiter is
+	// split, unbounded by default
+	MaxLineBytes int
+	// TimestampLines - stamps every line written to Out, Err and the
+	// additional writers, the copy sent to stdio is not stamped
+	TimestampLines bool
+	// TimestampLayout - the time layout of the stamps, RFC3339Nano by default
+	TimestampLayout string
+	// TailLines - keeps the last lines of combined output in Info.Tail
+	TailLines int
+	// TailBytes - bounds the total size of Info.Tail, 64KiB by default
+	TailBytes int
+	// OutputHistory - keeps the recent lines of output from the start on so
+	// that WaitForOutput can be called once the command is running, it is
+	// otherwise only kept when WaitForOutput is called before Start
+	OutputHistory bool
+	// MaxOutputBytes - caps the output written to Out, Err and the
+	// additional writers per stream, output beyond it is dropped, when lines
+	// are prefixed or timestamped the cap falls on a line boundary
+	MaxOutputBytes int64
+	// KillOnMaxOutput - kills the command when MaxOutputBytes is exceeded
+	KillOnMaxOutput bool
+	// Redact - secrets replaced with **** before the output reaches any
+	// writer, a secret must not span lines
+	Redact []string
+	// RedactPatterns - patterns replaced like Redact, matches longer than
+	// RedactWindow may be missed when they are split across writes
+	RedactPatterns []*regexp.Regexp
+	// RedactWindow - the longest match of RedactPatterns, 256 by default
+	RedactWindow int
+	// OmitArgs - leaves Info.Args empty, for commands that carry secrets
+	// in their arguments
+	OmitArgs bool
+	// Readiness - polled after the command starts until it passes, see Ready
+	Readiness ReadinessCheck
+	// ReadinessInterval - the polling interval of Readiness, 100ms by default
+	ReadinessInterval time.Duration
+	// OutFile - writes stdout to a file as well, the file is synced and
+	// closed before the final Info is delivered
+	OutFile *FileOutput
+	// ErrFile - writes stderr to a file as well, see OutFile
+	ErrFile *FileOutput
+	// Gzip - compresses the combined output into a gzip stream that is
+	// completed before the final Info is delivered
+	Gzip *GzipOutput
+	// AsyncOutput - queues the output for Out, Err and the additional
+	// writers so a slow writer does not stall the command
+	AsyncOutput *AsyncOutput
+	// Raw - writes stdout unchanged to Out, OutWriters, OutFile and Gzip
+	// only, it is not copied to the stdout of this process, split into
+	// lines, decorated, redacted or limited
+	Raw bool
+	// Transcript - records the output of both streams in order
+	Transcript Transcript
+	// EventLog - receives a JSON object per line for every lifecycle
+	// event of the command, see Subscribe, each written with a single
+	// Write so commands can share a log, write errors are ignored
+	EventLog io.Writer
 }
 
 // Info -
 type Info struct {
-	Error    error
-	RunT     time.Duration
-	Pid      int
-	Exit     int
+	// Name and Args - the command as it was started
+	Name  string
+	Args  []string
+	Error error
+	RunT  time.Duration
+	Pid   int
+	// Pgid - the process group of the command, Terminate and Kill signal
+	// it unless it is the group of this process
+	Pgid int
+	// Exit - the exit status of the command, when a signal ended it as
+	// set by Options.ExitCodeConvention, -1 by default
+	Exit int
+	// Signal - the signal that ended the command, zero when it exited
+	Signal   syscall.Signal
 	StartT   int64
 	EndT     int64
 	Finished bool
 	Signaled bool
+	Killed   bool
+	TimedOut bool
+	Attempts int
+	// State - the state of the command when the Info was taken
+	State State
+	// Reason - why the command ended
+	Reason Reason
+	// Wait - the details of how the command ended
+	Wait WaitDetails
+	// UserTime and SystemTime - the cpu time the command used, MaxRSS -
+	// its peak resident set size in bytes, zero on windows
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     int64
+	// IOReadBytes and IOWriteBytes - the bytes the command and the
+	// children it waited for read from and wrote to storage, from
+	// /proc/<pid>/io on linux, zero elsewhere or when it can not be read
+	IOReadBytes  int64
+	IOWriteBytes int64
+	// Uid, Gid and Username - the user the command runs as, the current
+	// user unless Options.Usr or Options.Username is set
+	Uid      int
+	Gid      int
+	Username string
+	// ExtraFiles - the number of descriptors passed after stdio
+	ExtraFiles int
+	// Caps - the capabilities raised in the ambient set of the command
+	Caps []string
+	// Cgroup - the cgroup the command ran in, empty when cgroup v2 is
+	// not available
+	Cgroup string
+	// WriteError - the errors of writers in Options.OutWriters and
+	// Options.ErrWriters that failed
+	WriteError error
+	// Tail - the most recent lines of combined output, see Options.TailLines
+	Tail []string
+	// StdoutBytes - the number of bytes the command wrote to stdout, 0
+	// when it writes to a file such as the terminal directly
+	StdoutBytes int64
+	// StderrBytes - the number of bytes the command wrote to stderr, see
+	// StdoutBytes
+	StderrBytes int64
+	// OutputTruncated - output was dropped because of Options.MaxOutputBytes
+	OutputTruncated bool
+	// DroppedBytes - output dropped by a full Options.AsyncOutput queue
+	DroppedBytes int64
+	// GzipRawBytes and GzipBytes - the output written to Options.Gzip
+	// before and after compression
+	GzipRawBytes int64
+	GzipBytes    int64
+}
+
+// WaitDetails - the wait status of a command beyond its exit and signal,
+// the fields a platform does not report stay zero
+type WaitDetails struct {
+	// CoreDump - the command dumped core
+	CoreDump bool
+	// StopSignal - the signal that stopped the command
+	StopSignal syscall.Signal
+	// Continued - the command was continued
+	Continued bool
+	// TrapCause - the ptrace event of a trap stop
+	TrapCause int
 }
 
-type status int
+// StartResult - the outcome of starting a command
+type StartResult struct {
+	Pid       int
+	StartedAt time.Time
+	Err       error
+}
+
+// State - the state of a command
+type State int
 
 const (
-	_uninitialized status = iota
-	_exited
-	_running
-	_signaled
+	// Created - the command has not started
+	Created State = iota
+	// Exited - the command exited by itself, or failed to start
+	Exited
+	// Running - the command is running
+	Running
+	// Signaled - the command was terminated through the CmdIo and has
+	// not exited yet
+	Signaled
+	// Killed - the command was killed through the CmdIo and has not
+	// exited yet
+	Killed
+	// Terminated - the command exited after it was terminated or killed
+	// through the CmdIo, Info.Reason tells which
+	Terminated
 )
 
+var stateNames = [...]string{
+	Created:    "created",
+	Exited:     "exited",
+	Running:    "running",
+	Signaled:   "signaled",
+	Killed:     "killed",
+	Terminated: "terminated",
+}
+
+// String - the name of the state
+func (s State) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// MarshalText - encodes the state as its name
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText - decodes the name of a state
+func (s *State) UnmarshalText(b []byte) error {
+	for state, name := range stateNames {
+		if name == string(b) {
+			*s = State(state)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", b)
+}
+
+// Reason - why a command ended
+type Reason int
+
+const (
+	// ReasonNone - the command has not ended
+	ReasonNone Reason = iota
+	// ReasonStartFailed - the command never ran
+	ReasonStartFailed
+	// ReasonExited - the command exited by itself
+	ReasonExited
+	// ReasonSignaled - a signal sent with Signal or from outside the CmdIo
+	// ended the command
+	ReasonSignaled
+	// ReasonTimedOut - a timeout, the deadline or Options.MaxCPUTime ended
+	// the command
+	ReasonTimedOut
+	// ReasonTerminated - Terminate or the context ended the command
+	ReasonTerminated
+	// ReasonKilled - Kill ended the command
+	ReasonKilled
+)
+
+var reasonNames = [...]string{
+	ReasonNone:        "none",
+	ReasonStartFailed: "start_failed",
+	ReasonExited:      "exited",
+	ReasonSignaled:    "signaled",
+	ReasonTimedOut:    "timed_out",
+	ReasonTerminated:  "terminated",
+	ReasonKilled:      "killed",
+}
+
+// String - the name of the reason
+func (r Reason) String() string {
+	if r >= 0 && int(r) < len(reasonNames) {
+		return reasonNames[r]
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+// MarshalText - encodes the reason as its name
+func (r Reason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText - decodes the name of a reason
+func (r *Reason) UnmarshalText(b []byte) error {
+	for reason, name := range reasonNames {
+		if name == string(b) {
+			*r = Reason(reason)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown reason %q", b)
+}
+
 // CmdIo -
 type CmdIo struct {
+	opt Options
 	in  io.Reader
 	out io.Writer
 	err io.Writer
 	env []string
 	lok *sync.Mutex
 	usr *user.User
+	tmo time.Duration
+	idl time.Duration
+	ddl time.Time
+	wdl time.Duration
+	dtc bool
+	act int64
+	obc int64
+	dpb int64
+	fls []flusher
+	cgr *cgroup
+	ofw *fileWriter
+	efw *fileWriter
+	gzw *gzipWriter
+	ebc int64
 	ini *sync.Once
-	sta status
+	ran bool
+	cls bool
+	rel relauncher
+	rst chan Info
+	hlt chan struct{}
+	sta State
 	inf Info
+	pgd int
+	kil func(pid int, sig syscall.Signal) error
+	evh *eventHub
+	ipr *os.File
+	opw *os.File
+	epw *os.File
+	obf *bytes.Buffer
+	tal *tailRing
+	olg *outputLog
+	osp []*lineWriter
+	esp []*lineWriter
+	fin Info
+	why error
 	str time.Time
 	ech chan Info
 	sch chan bool
+	res chan StartResult
+	rdy chan error
+	rdd bool
+	rcn context.CancelFunc
 	syn chan struct{}
+	ctx context.Context
+	cnl context.CancelCauseFunc
 	ncp noCopy
 }
 
+var _ io.Closer = (*CmdIo)(nil)
+
+// detached holds the pids of detached commands, signals are never
+// forwarded to them
+var detached sync.Map
+
+// handler installs the signal handler once for all commands, unhandle
+// removes it once
+var (
+	handler  sync.Once
+	unhandle sync.Once
+)
+
+// DisableSignalHandling - keeps this package from intercepting the signals
+// of this process, for applications that handle them on their own. The
+// handler is otherwise installed by the first Start and forwards the signals
+// to the running commands, one already installed is removed. It can not be
+// enabled again
+func DisableSignalHandling() {
+	unhandle.Do(func() {
+		// waits for an install in progress, or prevents it
+		handler.Do(func() {})
+		stopSignalHandler()
+	})
+}
+
+// managed holds the running commands by pid, the signals this process
+// receives are forwarded to them and to nothing else
+var managed sync.Map
+
 // New - creates a new CmdIo
 func New(optFn func() *Options) *CmdIo {
 	opts := optFn()
 	usr := opts.Usr
-	if usr == nil {
+	if usr == nil && opts.Username == "" {
 		usr, _ = user.Current()
 	}
-	return &CmdIo{
+	c := &CmdIo{
+		opt: *opts,
 		in:  opts.In,
 		out: opts.Out,
 		err: opts.Err,
 		env: opts.Env,
 		usr: usr,
+		tmo: opts.Timeout,
+		idl: opts.IdleTimeout,
+		ddl: opts.Deadline,
+		wdl: opts.WaitDelay,
+		dtc: opts.Detach,
 		lok: &sync.Mutex{},
 		ini: &sync.Once{},
 		inf: Info{Pid: 0, Exit: -1},
-		sta: _uninitialized,
+		sta: Created,
+		kil: kill,
+		evh: newEventHub(opts.EventLog),
 		ech: make(chan Info, 1),
 		sch: make(chan bool, 1),
+		res: make(chan StartResult, 1),
+		rdy: make(chan error, 1),
 		syn: make(chan struct{}),
+		hlt: make(chan struct{}),
+		rst: make(chan Info, 16),
+	}
+	c.ctx, c.cnl = context.WithCancelCause(context.Background())
+	if opts.OutputHistory {
+		c.keepOutput()
+	}
+	if opts.TailLines > 0 {
+		c.tal = &tailRing{max: opts.TailLines, cap: opts.TailBytes}
+		if c.tal.cap <= 0 {
+			c.tal.cap = defaultTailBytes
+		}
+		c.osp = append(c.osp, c.lineWriter(c.tal.push, nil))
+		c.esp = append(c.esp, c.lineWriter(c.tal.push, nil))
+	}
+	if opts.OnStdoutLine != nil {
+		cb := newLineCallback(opts.OnStdoutLine)
+		c.osp = append(c.osp, c.lineWriter(cb.push, cb.close))
+	}
+	if opts.OnStderrLine != nil {
+		cb := newLineCallback(opts.OnStderrLine)
+		c.esp = append(c.esp, c.lineWriter(cb.push, cb.close))
+	}
+	if opts.KeepAlive != nil {
+		c.rel = &keepAlive{opt: *opts.KeepAlive}
 	}
+	return c
 }
 
-// Start - asynchronously starts a command
+// Start - asynchronously starts a command, the returned Info channel
+// delivers the final Info to a single consumer, use Wait or JoinInfo when
+// several goroutines need the outcome
 func (c *CmdIo) Start(name string, args ...string) (<-chan bool, <-chan Info) {
-	init := false
-	c.ini.Do(func() {
-		init = true
-		go signalHandler()
-		go c.runFn(name, args...)
-	})
-	if !init {
-		c.ech <- Info{
-			Error:    errors.New("already executed, can not reuse CmdIo"),
-			RunT:     0,
-			Pid:      0,
-			Exit:     0,
-			StartT:   0,
-			EndT:     0,
-			Finished: true,
-			Signaled: false,
-		}
+	return c.StartContext(context.Background(), name, args...)
+}
+
+// StartContext - asynchronously starts a command, the command is
+// terminated when ctx is done before the command completes
+func (c *CmdIo) StartContext(ctx context.Context, name string, args ...string) (<-chan bool, <-chan Info) {
+	if e := c.start(ctx, name, args...); e != nil {
+		sch := make(chan bool, 1)
+		ech := make(chan Info, 1)
+		sch <- false
+		ech <- Info{Error: e, Exit: -1, Finished: true, Reason: ReasonStartFailed}
+		return sch, ech
 	}
 	return c.sch, c.ech
 }
 
+// StartE - asynchronously starts a command, failures that can be detected
+// before the command is started are returned synchronously
+func (c *CmdIo) StartE(name string, args ...string) (<-chan Info, error) {
+	c.lok.Lock()
+	ran, cls := c.ran, c.cls
+	c.lok.Unlock()
+
+	switch {
+	case cls:
+		return nil, ErrClosed
+	case ran:
+		return nil, ErrReused
+	}
+	if e := c.validate(name); e != nil {
+		return nil, e
+	}
+	if e := c.start(context.Background(), name, args...); e != nil {
+		return nil, e
+	}
+	return c.ech, nil
+}
+
+// Reset - returns a new CmdIo with the same Options, ready to be started
+func (c *CmdIo) Reset() *CmdIo {
+	return New(func() *Options {
+		opts := c.opt
+		return &opts
+	})
+}
+
 // Run - synchronously runs a command
 func (c *CmdIo) Run(name string, args ...string) *Info {
-	_, complete := c.Start(name, args...)
+	return c.RunContext(context.Background(), name, args...)
+}
+
+// RunContext - synchronously runs a command, the command is terminated
+// when ctx is done before the command completes
+func (c *CmdIo) RunContext(ctx context.Context, name string, args ...string) *Info {
+	_, complete := c.StartContext(ctx, name, args...)
 	info := <-complete
 	return &info
 }
 
-// Terminate - kills a command
+// Output - synchronously runs a command and returns its stdout, which is
+// not copied to the stdout of this process, along with the final Info. The
+// output collected so far is returned when the command fails
+func (c *CmdIo) Output(name string, args ...string) ([]byte, *Info) {
+	buf := &bytes.Buffer{}
+	c.lok.Lock()
+	if !c.ran {
+		c.obf = buf
+	}
+	c.lok.Unlock()
+
+	info := c.Run(name, args...)
+	return buf.Bytes(), info
+}
+
+// Terminate - kills a command, returns ErrNotStarted when the command
+// has not been started and nil when it has already finished
 func (c *CmdIo) Terminate() error {
 	c.lok.Lock()
 	defer c.lok.Unlock()
 
-	if c.sta == _uninitialized || c.inf.Finished {
-		return nil
+	if c.cls {
+		return ErrClosed
 	}
+	return c.terminate()
+}
 
-	c.sta = _signaled
-	c.inf.Signaled = true
-	return syscall.Kill(-c.inf.Pid, syscall.SIGTERM)
+// Close - kills a running command and waits for it to complete, releasing
+// its resources, any further calls return ErrClosed
+func (c *CmdIo) Close() error {
+	c.lok.Lock()
+	if c.cls {
+		c.lok.Unlock()
+		return ErrClosed
+	}
+	c.cls = true
+	e := c.kill()
+	c.lok.Unlock()
+
+	c.ini.Do(func() {
+		c.lok.Lock()
+		c.fin = Info{Error: ErrClosed, Exit: -1, Finished: true, Reason: ReasonStartFailed}
+		c.lok.Unlock()
+		c.evh.exited(ExitedEvent{At: time.Now(), Info: c.fin})
+		c.flushLines()
+		c.closePipes()
+		close(c.rst)
+		c.cnl(ErrClosed)
+		close(c.syn)
+	})
+	<-c.syn
+	return e
 }
 
 // Info - returns a copy of the current state of a command
@@ -153,113 +814,1218 @@ func (c *CmdIo) Info() Info {
 	defer c.lok.Unlock()
 
 	switch c.sta {
-	case _running:
+	case Running:
 		c.inf.RunT = time.Now().Sub(c.str)
-	case _exited:
+	case Exited, Terminated:
 		c.inf.Finished = true
 	}
+	if c.tal != nil {
+		c.inf.Tail = c.tal.lines()
+	}
+	c.inf.StdoutBytes = atomic.LoadInt64(&c.obc)
+	c.inf.StderrBytes = atomic.LoadInt64(&c.ebc)
+	c.inf.DroppedBytes = atomic.LoadInt64(&c.dpb)
+	c.inf.State = c.sta
 	return c.inf
 }
 
-// Join -
+// State - returns the state of a command
+func (c *CmdIo) State() State {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	return c.sta
+}
+
+// IsRunning - reports whether the command is running
+func (c *CmdIo) IsRunning() bool {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	return c.sta == Running
+}
+
+// Pid - returns the pid of the command once it started, false before it
+// started or when it failed to start
+func (c *CmdIo) Pid() (int, bool) {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	return c.inf.Pid, c.sta != Created && c.inf.Pid > 0
+}
+
+// Wait - blocks until a started command completes and returns the final Info
+func (c *CmdIo) Wait() *Info {
+	c.lok.Lock()
+	ran := c.ran
+	c.lok.Unlock()
+
+	if !ran {
+		return &Info{Error: ErrNotStarted, Exit: -1}
+	}
+	info := c.final()
+	return &info
+}
+
+// Started - returns a channel that delivers the StartResult of a command,
+// it is fed alongside the bool channel returned by Start
+func (c *CmdIo) Started() <-chan StartResult {
+	return c.res
+}
+
+// Restarts - returns a channel that delivers the Info of every completed
+// generation of a command, snapshots are dropped when the consumer falls
+// behind, the channel is closed once the command completes
+func (c *CmdIo) Restarts() <-chan Info {
+	return c.rst
+}
+
+// Context - returns a context that is done once the command completes,
+// context.Cause returns the run error or context.Canceled on success
+func (c *CmdIo) Context() context.Context {
+	return c.ctx
+}
+
+// Join - returns a channel that is closed once the command completes
 func (c *CmdIo) Join() <-chan struct{} {
 	return c.syn
 }
 
-func (c *CmdIo) runFn(name string, args ...string) {
+// JoinInfo - returns a channel that delivers the final Info once the
+// command completes and is then closed, each call gets its own channel
+func (c *CmdIo) JoinInfo() <-chan Info {
+	ch := make(chan Info, 1)
+	go func() {
+		ch <- c.final()
+		close(ch)
+	}()
+	return ch
+}
+
+// defaultInfoStreamInterval - the interval of InfoStream when it is not
+// positive
+const defaultInfoStreamInterval = time.Second
+
+// InfoStream - returns a channel that delivers an Info every interval
+// while the command runs and the final Info once it completes or the CmdIo
+// is closed, then is closed. Snapshots are dropped when the consumer falls
+// behind, the final Info replaces an unread one, each call gets its own
+// channel
+func (c *CmdIo) InfoStream(interval time.Duration) <-chan Info {
+	if interval <= 0 {
+		interval = defaultInfoStreamInterval
+	}
+	ch := make(chan Info, 1)
+	t := time.NewTicker(interval)
+	go func() {
+		defer close(ch)
+		defer t.Stop()
+		for {
+			select {
+			case <-c.syn:
+				info := c.final()
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- info
+				return
+			case <-t.C:
+				if c.State() != Running {
+					continue
+				}
+				select {
+				case ch <- c.Info():
+				default:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// TerminateAndWait - kills a command and blocks until it has exited or the
+// timeout elapses
+func (c *CmdIo) TerminateAndWait(timeout time.Duration) (*Info, error) {
+	if e := c.Terminate(); e != nil {
+		return nil, e
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-c.syn:
+		info := c.Info()
+		return &info, nil
+	case <-t.C:
+		return nil, ErrWaitTimeout
+	}
+}
+
+// Signal - sends a signal to the process group of a command
+func (c *CmdIo) Signal(sig syscall.Signal) error {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	switch {
+	case c.cls:
+		return ErrClosed
+	case c.inf.Finished || c.inf.EndT > 0:
+		return ErrAlreadyFinished
+	case c.sta == Created:
+		return ErrNotStarted
+	}
+	if e := c.signal(sig); e != nil {
+		return c.wrap(fmt.Sprintf("signal %d", int(sig)), e)
+	}
+	c.evh.publish(SignaledEvent{At: time.Now(), Pid: c.inf.Pid, Signal: sig})
+	return nil
+}
+
+// Kill - force kills the process group of a command
+func (c *CmdIo) Kill() error {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	if c.cls {
+		return ErrClosed
+	}
+	return c.kill()
+}
+
+// TerminateGracefully - kills a command, escalating to SIGKILL when the
+// command has not exited within the grace period
+func (c *CmdIo) TerminateGracefully(grace time.Duration) error {
+	if e := c.Terminate(); e != nil {
+		return e
+	}
+
+	t := time.NewTimer(grace)
+	defer t.Stop()
+	select {
+	case <-c.syn:
+		return nil
+	case <-t.C:
+	}
+
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	if c.sta == Created || c.inf.Finished {
+		return nil
+	}
+	if e := c.kill(); e != nil {
+		return e
+	}
+	return ErrKilled
+}
+
+func (c *CmdIo) start(ctx context.Context, name string, args ...string) error {
+	init := false
+	c.ini.Do(func() {
+		init = true
+		// the caller may reuse args once Start returns
+		args = append([]string{}, args...)
+		c.lok.Lock()
+		c.ran = true
+		c.inf.Name = name
+		c.evh.named(name)
+		if !c.opt.OmitArgs {
+			c.inf.Args = append([]string{}, args...)
+		}
+		c.lok.Unlock()
+		handler.Do(startSignalHandler)
+		go c.runFn(ctx, name, args...)
+	})
+	if !init {
+		c.lok.Lock()
+		defer c.lok.Unlock()
+		if c.cls {
+			return ErrClosed
+		}
+		return ErrReused
+	}
+	return nil
+}
+
+func (c *CmdIo) validate(name string) error {
+	if name == "" {
+		return ErrNoCommand
+	}
+	if e := c.check(); e != nil {
+		return e
+	}
+	if c.opt.Chroot != "" {
+		// the command is resolved inside the new root
+		name = filepath.Join(c.opt.Chroot, name)
+	}
+	if _, e := exec.LookPath(name); e != nil {
+		return e
+	}
+	_, _, e := c.credential()
+	return e
+}
+
+func isDir(path string) error {
+	st, e := os.Stat(path)
+	if e != nil {
+		return e
+	}
+	if !st.IsDir() {
+		return &os.PathError{Op: "stat", Path: path, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// check validates the combination of Options
+func (c *CmdIo) check() error {
+	in := 0
+	for _, set := range []bool{c.in != nil && c.in != os.Stdin, c.opt.InString != "", c.opt.InBytes != nil, c.opt.NoStdin} {
+		if set {
+			in++
+		}
+	}
+	if in > 1 {
+		return fmt.Errorf("%w: only one of In, InString, InBytes and NoStdin can be set", ErrOptions)
+	}
+	if c.opt.Usr != nil && c.opt.Username != "" {
+		return fmt.Errorf("%w: only one of Usr and Username can be set", ErrOptions)
+	}
+	if e := supported(&c.opt); e != nil {
+		return e
+	}
+	for _, names := range [][]string{c.opt.AmbientCaps, c.opt.DropCaps} {
+		if _, _, e := capabilities(names); e != nil {
+			return e
+		}
+	}
+	if c.opt.ExitCodeConvention < GoExitCode || c.opt.ExitCodeConvention > ShellExitCode {
+		return fmt.Errorf("%w: unknown ExitCodeConvention %d", ErrOptions, c.opt.ExitCodeConvention)
+	}
+	if c.opt.Nice < 0 && os.Geteuid() != 0 {
+		return fmt.Errorf("%w: a negative Nice requires root", ErrOptions)
+	}
+	if c.opt.Chroot != "" {
+		if e := isDir(c.opt.Chroot); e != nil {
+			return fmt.Errorf("chroot: %w", e)
+		}
+	}
+	if c.opt.Dir != "" {
+		if e := isDir(filepath.Join(c.opt.Chroot, c.opt.Dir)); e != nil {
+			return fmt.Errorf("working directory: %w", e)
+		}
+	}
+	if c.opt.EnvFile != "" {
+		if _, e := c.Environ(); e != nil {
+			return fmt.Errorf("env file: %w", e)
+		}
+	}
+	return nil
+}
+
+func (c *CmdIo) terminate() error {
+	if c.rcn != nil {
+		c.rcn()
+	}
+	if c.ran {
+		c.halt()
+	}
+	switch {
+	case c.inf.Finished || c.inf.EndT > 0:
+		return nil
+	case c.sta == Created:
+		return ErrNotStarted
+	}
+
+	sig := syscall.SIGTERM
+	if c.opt.Unshare.PID {
+		// init of the namespace, its death kills the whole namespace
+		sig = syscall.SIGKILL
+	}
+	// the state changes only once the signal was sent
+	if e := c.signal(sig); e != nil {
+		if e == syscall.ESRCH {
+			// exited before the signal was delivered
+			return nil
+		}
+		return c.wrap("terminate", e)
+	}
+	c.sta = Signaled
+	c.inf.Signaled = true
+	c.evh.publish(SignaledEvent{At: time.Now(), Pid: c.inf.Pid, Signal: sig})
+	return nil
+}
+
+func (c *CmdIo) kill() error {
+	if c.ran {
+		c.halt()
+	}
+	if c.sta == Created || c.inf.Finished || c.inf.EndT > 0 {
+		return nil
+	}
+
+	if c.cgr != nil {
+		c.cgr.kill()
+	}
+	killChildren(c.inf.Pid, syscall.SIGKILL)
+	if e := c.kil(c.group(), syscall.SIGKILL); e != nil {
+		if e == syscall.ESRCH {
+			// exited before the signal was delivered
+			return nil
+		}
+		return c.wrap("kill", e)
+	}
+	c.sta = Killed
+	c.inf.Signaled = true
+	c.inf.Killed = true
+	c.evh.publish(SignaledEvent{At: time.Now(), Pid: c.inf.Pid, Signal: syscall.SIGKILL})
+	return nil
+}
+
+func (c *CmdIo) runFn(ctx context.Context, name string, args ...string) {
+	started := false
 	defer func() {
-		c.ech <- c.Info()
-		close(c.syn)
+		if !started {
+			c.started(StartResult{Err: c.Info().Error})
+		}
+		c.finish()
 	}()
 
-	cmd := c.newCmd(name, args...)
+	c.lok.Lock()
+	rel := c.rel
+	c.lok.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		c.exec(ctx, attempt, &started, name, args...)
+		info := c.Info()
+		select {
+		case c.rst <- info:
+		default:
+		}
+		if rel == nil || c.dtc {
+			return
+		}
+
+		d, e := rel.next(attempt, info)
+		if e != nil {
+			if e != errStop {
+				c.lok.Lock()
+				c.inf.Error = e
+				c.lok.Unlock()
+			}
+			return
+		}
+		select {
+		case <-c.hlt:
+			// terminated or killed, there is no restart to announce
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+		c.evh.publish(RestartScheduledEvent{At: time.Now(), Attempt: attempt + 1, Delay: d, Info: info})
+		if !c.backoff(ctx, d) {
+			return
+		}
+	}
+}
+
+func (c *CmdIo) exec(ctx context.Context, attempt int, started *bool, name string, args ...string) {
+	c.lok.Lock()
+	c.inf.Attempts = attempt
+	c.why = nil
+	c.lok.Unlock()
+
 	now := time.Now()
-	if e := cmd.Start(); e != nil {
-		c.complete(&now, e)
-		c.sch <- false
+	if c.closed() {
+		c.failStart(&now, ErrClosed)
+		return
+	}
+	if e := ctx.Err(); e != nil {
+		c.failStart(&now, e)
+		return
+	}
+	if !c.ddl.IsZero() && !now.Before(c.ddl) {
+		c.lok.Lock()
+		c.inf.TimedOut = true
+		c.lok.Unlock()
+		c.failStart(&now, ErrDeadline)
+		return
+	}
+
+	if name == "" {
+		c.failStart(&now, ErrNoCommand)
+		return
+	}
+	if e := c.check(); e != nil {
+		c.failStart(&now, e)
+		return
+	}
+	cred, usr, e := c.credential()
+	if e != nil {
+		c.failStart(&now, fmt.Errorf("credential of %s: %w", name, e))
+		return
+	}
+	c.lok.Lock()
+	c.inf.Uid, c.inf.Gid = os.Getuid(), os.Getgid()
+	if cred != nil {
+		c.inf.Uid, c.inf.Gid = int(cred.Uid), int(cred.Gid)
+	}
+	c.inf.Username = usr.Username
+	c.inf.ExtraFiles = len(c.opt.ExtraFiles) + len(c.opt.NamedFiles)
+	_, c.inf.Caps, _ = capabilities(c.opt.AmbientCaps)
+	c.lok.Unlock()
+	if e := c.openFiles(); e != nil {
+		c.failStart(&now, e)
+		return
+	}
+	if c.opt.CgroupPath != "" {
+		cg, e := newCgroup(&c.opt)
+		if e != nil {
+			c.failStart(&now, e)
+			return
+		}
+		if cg != nil {
+			c.lok.Lock()
+			c.cgr = cg
+			c.inf.Cgroup = cg.dir
+			c.lok.Unlock()
+			defer c.removeCgroup()
+		}
+	}
+
+	cmd := c.newCmd(ctx, cred, name, args...)
+	defer c.flushWriters()
+	if !c.dtc {
+		// the death signal is sent when the thread that started the
+		// command exits, keep it to this goroutine until the command exits
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	e = c.fork(cmd)
+	if c.cgr != nil {
+		c.cgr.closeFD()
+	}
+	if e != nil {
+		switch {
+		case !errors.Is(e, syscall.EPERM):
+		case c.opt.Unshare != (Unshare{}):
+			e = fmt.Errorf("unshare requires CAP_SYS_ADMIN: %w", e)
+		case c.opt.Chroot != "":
+			e = fmt.Errorf("chroot %s requires CAP_SYS_CHROOT: %w", c.opt.Chroot, e)
+		case len(c.opt.AmbientCaps) > 0:
+			e = fmt.Errorf("ambient capabilities must be held: %w", e)
+		}
+		c.failStart(&now, e)
+		return
+	}
+	defer release(cmd.Process.Pid)
+	if e := c.adjust(cmd.Process.Pid); e != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		c.failStart(&now, fmt.Errorf("adjust pid %d (%s): %w", cmd.Process.Pid, name, e))
 		return
 	}
 
 	c.init(&now, cmd)
-	c.sch <- true
-	e := cmd.Wait()
+	c.evh.publish(StartedEvent{At: now, Pid: cmd.Process.Pid, Attempt: attempt})
+	if !*started {
+		*started = true
+		c.started(StartResult{Pid: cmd.Process.Pid, StartedAt: now})
+	}
+
+	if c.dtc {
+		detached.Store(cmd.Process.Pid, struct{}{})
+		_ = cmd.Process.Release()
+		return
+	}
+	managed.Store(cmd.Process.Pid, c)
+
+	done := make(chan struct{})
+	go c.watch(done)
+	rd, wr := waitIO(cmd.Process.Pid)
+	e = cmd.Wait()
+	managed.Delete(cmd.Process.Pid)
+	close(done)
+	c.flushWriters()
+	c.lok.Lock()
+	c.inf.IOReadBytes, c.inf.IOWriteBytes = rd, wr
+	if cmd.ProcessState != nil {
+		c.inf.UserTime, c.inf.SystemTime, c.inf.MaxRSS = rusage(cmd.ProcessState)
+	}
+	c.lok.Unlock()
 	c.complete(&now, e)
 }
 
-func (c *CmdIo) newCmd(name string, args ...string) *exec.Cmd {
-	uid, _ := strconv.Atoi(c.usr.Uid)
-	gid, _ := strconv.Atoi(c.usr.Gid)
+// umask serializes the starts setting Options.Umask with all other starts
+var umask sync.RWMutex
+
+// fork starts cmd, the umask is process wide so it is set around the start
+// while no other command is starting. NoNewPrivs and DropCaps are set on
+// the starting thread
+func (c *CmdIo) fork(cmd *exec.Cmd) error {
+	if e := confine(&c.opt); e != nil {
+		return e
+	}
+	start := cmd.Start
+	if len(c.opt.Rlimits) > 0 {
+		start = func() error { return startLimited(cmd, c.opt.Rlimits) }
+	}
+	if c.opt.Umask == nil {
+		umask.RLock()
+		defer umask.RUnlock()
+		return start()
+	}
+
+	umask.Lock()
+	defer umask.Unlock()
+	if c.opt.Umask != nil {
+		old := setUmask(*c.opt.Umask)
+		defer setUmask(old)
+	}
+	return start()
+}
+
+// removeCgroup removes the cgroup of an attempt once it has exited, along
+// with whatever was left running in it
+func (c *CmdIo) removeCgroup() {
+	c.lok.Lock()
+	cg := c.cgr
+	c.cgr = nil
+	c.lok.Unlock()
+
+	if cg != nil && !c.dtc {
+		_ = cg.remove()
+	}
+}
+
+// adjust applies the settings that can only be made once the command has
+// started, the command is killed when one fails
+func (c *CmdIo) adjust(pid int) error {
+	if e := attach(pid, &c.opt); e != nil {
+		return e
+	}
+	if c.opt.Nice != 0 {
+		if e := setNice(pid, c.opt.Nice); e != nil {
+			return fmt.Errorf("nice %d: %w", c.opt.Nice, e)
+		}
+	}
+	if len(c.opt.CPUSet) > 0 {
+		if e := setAffinity(pid, c.opt.CPUSet); e != nil {
+			return fmt.Errorf("cpu set %v: %w", c.opt.CPUSet, e)
+		}
+	}
+	if c.opt.OOMScoreAdj != nil {
+		if e := setOOMScoreAdj(pid, *c.opt.OOMScoreAdj); e != nil {
+			return fmt.Errorf("oom score adj %d: %w", *c.opt.OOMScoreAdj, e)
+		}
+	}
+	return nil
+}
 
-	cred := &syscall.Credential{
-		Uid:         uint32(uid),
-		Gid:         uint32(gid),
-		NoSetGroups: true,
+func (c *CmdIo) finish() {
+	c.flushLines()
+	c.closePipes()
+	c.closeFiles()
+	close(c.rst)
+	info := c.Info()
+	c.lok.Lock()
+	c.fin = info
+	c.lok.Unlock()
+	c.evh.exited(ExitedEvent{At: time.Now(), Info: info})
+	c.ech <- info
+	c.cnl(info.Error)
+	close(c.syn)
+}
+
+// group returns the target for signals sent to the process group of a
+// command, falling back to the pid when it shares the group of this process
+func (c *CmdIo) group() int {
+	if c.pgd <= 1 || c.pgd == getpgrp() {
+		// kill(-1) signals every process this process may signal
+		return c.inf.Pid
 	}
+	return -c.pgd
+}
 
-	cmd := exec.Command(name, args...)
-	cmd.SysProcAttr = syscallAttrs(cred)
+// wrap adds the operation and the command to err, the caller holds lok
+func (c *CmdIo) wrap(op string, err error) error {
+	return fmt.Errorf("%s pid %d (%s): %w", op, c.inf.Pid, c.inf.Name, err)
+}
+
+// forward passes a signal this process received to the managed commands
+func forward(sig syscall.Signal) {
+	managed.Range(func(_, v interface{}) bool {
+		c := v.(*CmdIo)
+		c.lok.Lock()
+		if c.sta == Running || c.sta == Signaled {
+			_ = c.signal(sig)
+		}
+		c.lok.Unlock()
+		return true
+	})
+}
+
+// signal sends sig to the process group of a command, or to the command
+// and its children when it shares the group of this process
+func (c *CmdIo) signal(sig syscall.Signal) error {
+	if c.cgr != nil {
+		c.cgr.signal(sig)
+	}
+	g := c.group()
+	if g > 0 {
+		killChildren(g, sig)
+	}
+	return c.kil(g, sig)
+}
+
+func (c *CmdIo) final() Info {
+	<-c.syn
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	return c.fin
+}
+
+func (c *CmdIo) closed() bool {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	return c.cls
+}
+
+func (c *CmdIo) started(r StartResult) {
+	c.res <- r
+	c.sch <- r.Err == nil
+	switch {
+	case r.Err != nil:
+		c.ready(r.Err)
+	case c.opt.Readiness != nil:
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.lok.Lock()
+		c.rcn = cancel
+		c.lok.Unlock()
+		go c.poll(ctx, cancel)
+	default:
+		c.ready(nil)
+	}
+}
+
+func (c *CmdIo) backoff(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return false
+	case <-c.hlt:
+		return false
+	}
+	select {
+	case <-c.hlt:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *CmdIo) halt() {
+	select {
+	case <-c.hlt:
+	default:
+		close(c.hlt)
+	}
+}
+
+// defaultCPUSampleInterval - how often Options.MaxCPUTime is checked when
+// Options.CPUSampleInterval is not set
+const defaultCPUSampleInterval = 250 * time.Millisecond
+
+func (c *CmdIo) watch(done <-chan struct{}) {
+	var expired <-chan time.Time
+	if c.tmo > 0 {
+		t := time.NewTimer(c.tmo)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	var deadline <-chan time.Time
+	if !c.ddl.IsZero() {
+		t := time.NewTimer(time.Until(c.ddl))
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	var idle <-chan time.Time
+	var it *time.Timer
+	if c.idl > 0 {
+		it = time.NewTimer(c.idl)
+		defer it.Stop()
+		idle = it.C
+	}
+
+	var sample <-chan time.Time
+	if c.opt.MaxCPUTime > 0 {
+		interval := c.opt.CPUSampleInterval
+		if interval <= 0 {
+			interval = defaultCPUSampleInterval
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		sample = t.C
+	}
+	c.lok.Lock()
+	pid := c.inf.Pid
+	c.lok.Unlock()
+
+	for {
+		select {
+		case <-expired:
+			c.stop(ErrTimeout)
+		case <-deadline:
+			c.stop(ErrDeadline)
+		case <-idle:
+			last := epoch.Add(time.Duration(atomic.LoadInt64(&c.act)))
+			if d := c.idl - time.Since(last); d > 0 {
+				it.Reset(d)
+				continue
+			}
+			c.stop(ErrIdleTimeout)
+		case <-sample:
+			if d, e := procCPU(pid); e != nil || d < c.opt.MaxCPUTime {
+				continue
+			}
+			c.stop(ErrCPUTime)
+		case <-done:
+		}
+		return
+	}
+}
+
+func (c *CmdIo) stop(why error) {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	if c.sta != Running {
+		return
+	}
+	c.why = why
+	c.inf.TimedOut = timedOut(why)
+	_ = c.terminate()
+}
+
+func (c *CmdIo) cancel(pid int, why error) error {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	c.why = why
+	if c.sta == Running {
+		return c.terminate()
+	}
+	// cancelled before init observed the start
+	return kill(-pid, syscall.SIGTERM)
+}
+
+// credential resolves the user a command runs as, Options.Username is
+// looked up and the current user is used when no user is given
+func (c *CmdIo) credential() (*credential, *user.User, error) {
+	usr := c.usr
+	if c.opt.Username != "" {
+		u, e := user.Lookup(c.opt.Username)
+		if e != nil {
+			return nil, nil, fmt.Errorf("user %s: %w", c.opt.Username, e)
+		}
+		usr = u
+	}
+	if usr == nil {
+		u, e := user.Current()
+		if e != nil {
+			return nil, nil, fmt.Errorf("current user: %w", e)
+		}
+		usr = u
+	}
+
+	cred, e := c.userCredential(usr)
+	return cred, usr, e
+}
+
+// self reports whether cred is the user of this process, with the groups
+// of the process unless Options.Groups is set
+func (c *CmdIo) self(cred *credential) bool {
+	return int(cred.Uid) == os.Getuid() && int(cred.Gid) == os.Getgid() && c.opt.Groups == nil
+}
+
+// defaultWaitDelay - how long completion waits for output held open by the
+// children of a command when Options.WaitDelay is not set
+const defaultWaitDelay = 2 * time.Second
+
+func (c *CmdIo) newCmd(ctx context.Context, cred *credential, name string, args ...string) *exec.Cmd {
+	if cred != nil && c.self(cred) {
+		// already running as the user, setting it can fail with EPERM
+		cred = nil
+	}
+	if c.dtc {
+		// a detached command outlives ctx
+		ctx = context.Background()
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = syscallAttrs(cred, &c.opt)
+	if c.cgr != nil {
+		c.cgr.attrs(cmd.SysProcAttr)
+	}
+	cmd.Cancel = func() error {
+		return c.cancel(cmd.Process.Pid, ctx.Err())
+	}
+	switch {
+	case c.wdl == 0:
+		cmd.WaitDelay = defaultWaitDelay
+	case c.wdl > 0:
+		cmd.WaitDelay = c.wdl
+	}
 
 	// wire IO
 	cmd.Stdin = os.Stdin
-	if c.in != nil && c.in != os.Stdin {
+	switch {
+	case c.in != nil && c.in != os.Stdin:
 		cmd.Stdin = c.in
+	case c.opt.InString != "":
+		cmd.Stdin = strings.NewReader(c.opt.InString)
+	case c.opt.InBytes != nil:
+		cmd.Stdin = bytes.NewReader(c.opt.InBytes)
+	case c.opt.NoStdin:
+		cmd.Stdin = nil
+	}
+	cmd.Stdout = c.tee(c.writers(c.out, c.files(c.opt.OutWriters, c.ofw)), os.Stdout)
+	cmd.Stderr = c.tee(c.writers(c.err, c.files(c.opt.ErrWriters, c.efw)), os.Stderr)
+	cmd.Stdout = c.decorated(prefixed(cmd.Stdout, c.opt.Prefix, c.opt.PrefixColor))
+	cmd.Stderr = c.decorated(prefixed(cmd.Stderr, c.opt.Prefix, c.opt.PrefixColor))
+	if c.opt.Quiet {
+		cmd.Stdin = nil
+		cmd.Stdout = io.Discard
+		cmd.Stderr = io.Discard
+	}
+	if c.obf != nil {
+		cmd.Stdout = c.limited(c.obf)
+		if c.out != nil && c.out != os.Stdout {
+			cmd.Stdout = c.limited(io.MultiWriter(c.out, c.obf))
+		}
+	}
+	if c.ipr != nil {
+		cmd.Stdin = c.ipr
+	}
+	if c.opw != nil {
+		cmd.Stdout = c.opw
+	}
+	if c.epw != nil {
+		cmd.Stderr = c.epw
 	}
-	cmd.Stdout = os.Stdout
-	if c.out != nil && c.out != os.Stdout {
-		cmd.Stdout = io.MultiWriter(c.out, os.Stdout)
+	cmd.Stdout = split(cmd.Stdout, c.osp)
+	cmd.Stderr = split(cmd.Stderr, c.esp)
+	if c.opt.Transcript != nil && !c.dtc {
+		t := &transcriber{trn: c.opt.Transcript}
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, t.writer(Stdout))
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, t.writer(Stderr))
+	}
+	cmd.Stdout = c.redact(cmd.Stdout)
+	cmd.Stderr = c.redact(cmd.Stderr)
+	if c.opt.Raw && !c.opt.Quiet {
+		cmd.Stdout = c.raw()
+	}
+
+	if c.idl > 0 {
+		cmd.Stdout = &activityWriter{w: cmd.Stdout, act: &c.act}
+		cmd.Stderr = &activityWriter{w: cmd.Stderr, act: &c.act}
 	}
-	cmd.Stderr = os.Stderr
-	if c.err != nil && c.err != os.Stderr {
-		cmd.Stderr = io.MultiWriter(c.err, os.Stderr)
+	cmd.Stdout = counted(cmd.Stdout, &c.obc)
+	cmd.Stderr = counted(cmd.Stderr, &c.ebc)
+
+	if c.dtc {
+		detachIO(cmd, c.in, c.out, c.err)
 	}
 
-	cmd.Dir = os.Getenv("PWD")
-	cmd.Env = os.Environ()
-	if len(c.env) > 0 {
-		cmd.Env = c.env
+	cmd.Dir = c.opt.Dir
+	switch {
+	case cmd.Dir != "":
+	case c.opt.Chroot != "":
+		cmd.Dir = "/"
+	default:
+		cmd.Dir, _ = os.Getwd()
 	}
+	cmd.Env, _ = c.Environ()
+	cmd.ExtraFiles, _ = c.extraFiles()
 
 	return cmd
 }
 
+// writers combines w and ws into a single writer, when ws is used every
+// writer is isolated so a failing writer does not stop the others
+func (c *CmdIo) writers(w io.Writer, ws []io.Writer) io.Writer {
+	if len(ws) == 0 {
+		return w
+	}
+
+	var all []io.Writer
+	for _, wr := range append([]io.Writer{w}, ws...) {
+		if wr != nil {
+			all = append(all, &isolatedWriter{w: wr, fail: c.writeFailed})
+		}
+	}
+	return io.MultiWriter(all...)
+}
+
+// extraFiles returns the files passed to a command after stdio, the named
+// files follow Options.ExtraFiles by name and their descriptors are
+// announced in CMDIO_FD_<name> variables
+func (c *CmdIo) extraFiles() ([]*os.File, []string) {
+	files := append([]*os.File{}, c.opt.ExtraFiles...)
+	names := make([]string, 0, len(c.opt.NamedFiles))
+	for n := range c.opt.NamedFiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var env []string
+	for _, n := range names {
+		env = append(env, fmt.Sprintf("CMDIO_FD_%s=%d", n, 3+len(files)))
+		files = append(files, c.opt.NamedFiles[n])
+	}
+	return files, env
+}
+
+// raw returns the stdout of a command in Options.Raw mode, only the
+// writers receiving the exact output are kept
+func (c *CmdIo) raw() io.Writer {
+	if c.opw != nil {
+		return c.opw
+	}
+	w := c.writers(c.out, c.files(c.opt.OutWriters, c.ofw))
+	if c.obf != nil {
+		w = c.obf
+		if c.out != nil && c.out != os.Stdout {
+			w = io.MultiWriter(c.out, c.obf)
+		}
+	}
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
+
+// limited caps the output written to w at Options.MaxOutputBytes
+func (c *CmdIo) limited(w io.Writer) io.Writer {
+	if c.opt.MaxOutputBytes <= 0 {
+		return w
+	}
+	return &limitWriter{w: w, n: c.opt.MaxOutputBytes, lines: c.lineMode(), hit: c.truncated}
+}
+
+// lineMode reports whether the output is decorated line by line
+func (c *CmdIo) lineMode() bool {
+	return c.opt.Prefix != "" || c.opt.TimestampLines
+}
+
+func (c *CmdIo) truncated() {
+	c.lok.Lock()
+	first := !c.inf.OutputTruncated
+	c.inf.OutputTruncated = true
+	c.lok.Unlock()
+	if first {
+		c.evh.publish(OutputTruncatedEvent{At: time.Now()})
+	}
+
+	if c.opt.KillOnMaxOutput {
+		c.stop(ErrOutputLimit)
+	}
+}
+
+func (c *CmdIo) writeFailed(e error) {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	c.inf.WriteError = errors.Join(c.inf.WriteError, e)
+}
+
+// tee wires w to the stdio file std, unless Options.NoTee is set the
+// output of w is copied to std as well, timestamps are only added to w
+func (c *CmdIo) tee(w io.Writer, std *os.File) io.Writer {
+	if w == nil || w == std {
+		return std
+	}
+	w = c.limited(c.async(w))
+	if c.opt.TimestampLines {
+		w = c.decorated(stamped(w, c.opt.TimestampLayout))
+	}
+	if c.opt.NoTee {
+		return w
+	}
+	return io.MultiWriter(w, std)
+}
+
+// detachIO wires the stdio of a detached command to the given files, or
+// the null device when they are not files, nothing is copied by cmdio
+func detachIO(cmd *exec.Cmd, in io.Reader, out, err io.Writer) {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, nil, nil
+	if f, ok := in.(*os.File); ok {
+		cmd.Stdin = f
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		cmd.Stdout = f
+	}
+	if f, ok := err.(*os.File); ok && f != os.Stderr {
+		cmd.Stderr = f
+	}
+}
+
 func (c *CmdIo) init(t *time.Time, cmd *exec.Cmd) {
 	c.lok.Lock()
 	defer c.lok.Unlock()
 
 	c.inf.Pid = cmd.Process.Pid
+	c.pgd = cmd.Process.Pid
+	if c.opt.ProcessGroup == Inherit {
+		c.pgd = getpgrp()
+	}
+	if g, e := getpgid(cmd.Process.Pid); e == nil {
+		c.pgd = g
+	}
+	c.inf.Pgid = c.pgd
+	c.inf.Finished = false
+	c.inf.Signaled = false
+	c.inf.Killed = false
+	c.inf.TimedOut = false
+	c.inf.Signal = 0
+	c.inf.Wait = WaitDetails{}
+	c.inf.Reason = ReasonNone
+	c.inf.UserTime, c.inf.SystemTime, c.inf.MaxRSS = 0, 0, 0
+	c.inf.IOReadBytes, c.inf.IOWriteBytes = 0, 0
+	c.inf.EndT = 0
+	c.inf.WriteError = nil
+	c.inf.OutputTruncated = false
+	atomic.StoreInt64(&c.act, int64(t.Sub(epoch)))
+	atomic.StoreInt64(&c.obc, 0)
+	atomic.StoreInt64(&c.ebc, 0)
+	atomic.StoreInt64(&c.dpb, 0)
 	c.inf.StartT = t.UnixNano()
-	c.sta = _running
+	c.inf.RunT = 0
+	c.str = *t
+	c.sta = Running
+	if c.cls {
+		// closed while starting
+		_ = c.kill()
+	}
+}
+
+// failStart ends an attempt that never ran
+func (c *CmdIo) failStart(t *time.Time, err error) {
+	c.endState(t, -1, 0, &StartError{Err: err}, false)
 }
 
 func (c *CmdIo) complete(t *time.Time, err error) {
 	code := 0
 	if err != nil {
-		code = exitErr(err)
+		code = exitErr(err, c.opt.ExitCodeConvention)
 	}
-	c.endState(t, code, err)
+	c.endState(t, code, exitSig(err), err, true)
 }
 
-func (c *CmdIo) endState(t *time.Time, code int, err error) {
+func (c *CmdIo) endState(t *time.Time, code int, sig syscall.Signal, err error, started bool) {
 	c.lok.Lock()
 	defer c.lok.Unlock()
 
 	c.inf.Error = err
+	if c.why != nil {
+		c.inf.Error = c.why
+	}
 	c.inf.Exit = code
-	c.inf.StartT = t.UnixNano()
-	c.inf.EndT = time.Now().UnixNano()
-	if c.sta != _signaled {
-		c.inf.Finished = true
-		c.sta = _exited
+	c.inf.Signal = sig
+	c.inf.Wait = waitDetails(err)
+	if sig > 0 {
+		c.inf.Signaled = true
+	}
+	end := time.Now()
+	c.inf.EndT = end.UnixNano()
+	c.inf.RunT = end.Sub(c.str)
+	if !started {
+		// nothing ran, a previous attempt may have left these set
+		c.inf.StartT = t.UnixNano()
+		c.inf.Pid = 0
+		c.inf.Pgid = 0
+		c.inf.RunT = 0
+		c.inf.UserTime, c.inf.SystemTime, c.inf.MaxRSS = 0, 0, 0
+		c.inf.IOReadBytes, c.inf.IOWriteBytes = 0, 0
+		c.inf.Signaled = false
+		c.inf.Killed = false
+		c.sta = Exited
+	}
+	switch {
+	case !started:
+		c.inf.Reason = ReasonStartFailed
+	case (c.sta == Signaled || c.sta == Killed) && c.inf.TimedOut:
+		c.inf.Reason = ReasonTimedOut
+	case c.sta == Killed:
+		c.inf.Reason = ReasonKilled
+	case c.sta == Signaled:
+		c.inf.Reason = ReasonTerminated
+	case sig > 0:
+		c.inf.Reason = ReasonSignaled
+	default:
+		c.inf.Reason = ReasonExited
+	}
+	c.inf.Finished = true
+	if c.sta == Signaled || c.sta == Killed {
+		c.sta = Terminated
+	} else {
+		c.sta = Exited
 	}
 }
 
-func exitErr(err error) int {
+func exitErr(err error, conv ExitCodeConvention) int {
 	if e, ok := err.(*exec.ExitError); ok {
 		ws := e.Sys().(syscall.WaitStatus)
-		if sig := ws.Signal(); sig > 0 {
-			return int(sig)
+		if ws.Signaled() {
+			switch conv {
+			case RawExitCode:
+				return int(ws.Signal())
+			case ShellExitCode:
+				return 128 + int(ws.Signal())
+			}
+			// the signal is in Info.Signal
+			return -1
 		}
 		return ws.ExitStatus()
 	}
+	// the command may have exited 0, but the run failed
+	return -1
+}
+
+func timedOut(err error) bool {
+	return err == ErrTimeout || err == ErrIdleTimeout || err == ErrDeadline || err == ErrCPUTime
+}
+
+func waitDetails(err error) WaitDetails {
+	var w WaitDetails
+	if e, ok := err.(*exec.ExitError); ok {
+		ws := e.Sys().(syscall.WaitStatus)
+		w.CoreDump = ws.CoreDump()
+		w.Continued = ws.Continued()
+		if ws.Stopped() {
+			w.StopSignal = ws.StopSignal()
+		}
+		if cause := ws.TrapCause(); cause > 0 {
+			w.TrapCause = cause
+		}
+	}
+	return w
+}
+
+func exitSig(err error) syscall.Signal {
+	if e, ok := err.(*exec.ExitError); ok {
+		ws := e.Sys().(syscall.WaitStatus)
+		if ws.Signaled() {
+			return ws.Signal()
+		}
+	}
 	return 0
 }
@@ -1,3 +1,6 @@
+//go:build !windows
+// +build !windows
+
 /*
 Copyright © 2020 streamz <bytecodenerd@gmail.com>
 
@@ -17,12 +20,28 @@ limitations under the License.
 package cmdio
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -50,6 +69,24 @@ func (r stringReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+var errWrite = errors.New("write failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWrite
+}
+
+type slowWriter struct {
+	bytes.Buffer
+	delay time.Duration
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.Buffer.Write(p)
+}
+
 func stdOptions() *Options {
 	usr, _ := user.Current()
 	return &Options{
@@ -106,44 +143,2990 @@ func TestReRun(t *testing.T) {
 	info := cmd.Run(Testdata + "program.sh")
 	assert.NoError(t, info.Error)
 	info = cmd.Run(Testdata + "program.sh")
-	assert.Error(t, info.Error)
+	assert.Equal(t, ErrReused, info.Error)
+
+	started, complete := cmd.Start(Testdata + "program.sh")
+	assert.False(t, <-started, "command should not start")
+	assert.Equal(t, ErrReused, (<-complete).Error)
 }
 
-func TestStart(t *testing.T) {
-	info := start("program.sh", stdOptions)
+func TestConcurrentStart(t *testing.T) {
+	cmd := New(stdOptions)
+	results := make(chan Info, 16)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, complete := cmd.Start(Testdata + "program.sh")
+			results <- <-complete
+		}()
+	}
+
+	ran := 0
+	for i := 0; i < cap(results); i++ {
+		select {
+		case info := <-results:
+			if info.Error == ErrReused {
+				continue
+			}
+			assertStart(t, &info)
+			ran++
+		case <-time.After(5 * time.Second):
+			t.Fatal("caller did not receive an outcome")
+		}
+	}
+	assert.Equal(t, 1, ran)
+}
+
+func TestReset(t *testing.T) {
+	cmd := New(stdOptions)
+	info := cmd.Run(Testdata + "program.sh")
+	assertStart(t, info)
+
+	cmd = cmd.Reset()
+	info = cmd.Run(Testdata + "program.sh")
 	assertStart(t, info)
 }
 
-func TestTerminate(t *testing.T) {
-	info, err := terminate("service.sh", stdOptions)
+func TestStartE(t *testing.T) {
+	cmd := New(stdOptions)
+	_, err := cmd.StartE("")
+	assert.Equal(t, ErrNoCommand, err)
+	_, err = cmd.StartE(Testdata + "missing.sh")
+	assert.Error(t, err)
+
+	complete, err := cmd.StartE(Testdata + "program.sh")
 	assert.NoError(t, err)
-	assertTerminate(t, info)
+	info := <-complete
+	assertStart(t, &info)
+
+	_, err = cmd.StartE(Testdata + "program.sh")
+	assert.Equal(t, ErrReused, err)
 }
 
-func TestStartBufIO(t *testing.T) {
-	expected := "hello world\n"
-	in := stringReader{
-		step: 0,
-		data: []string{expected},
+func TestStartECredential(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.Usr = &user.User{Uid: "nobody", Gid: "0", Username: "nobody"}
+		return o
+	}
+	_, err := New(opts).StartE(Testdata + "program.sh")
+	assert.Error(t, err)
+
+	info := New(opts).Run(Testdata + "program.sh")
+	assert.Contains(t, info.Error.Error(), `invalid uid "nobody"`)
+	assert.Zero(t, info.Pid)
+}
+
+func TestCredentialCurrentUser(t *testing.T) {
+	c := New(bufOptions(nil, nil, nil))
+	cred, _, err := c.credential()
+	assert.NoError(t, err)
+	cmd := c.newCmd(context.Background(), cred, Testdata+"program.sh")
+	assert.Nil(t, cmd.SysProcAttr.Credential)
+
+	c = New(func() *Options { return &Options{} })
+	cred, _, err = c.credential()
+	assert.NoError(t, err)
+	cmd = c.newCmd(context.Background(), cred, Testdata+"program.sh")
+	assert.Nil(t, cmd.SysProcAttr.Credential)
+	assertStart(t, c.Run(Testdata+"program.sh"))
+}
+
+func TestCredentialOtherUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
 	}
 	out := bytes.NewBufferString("")
-	err := bytes.NewBufferString("")
-	cmd := New(bufOptions(in, out, err))
-	info := cmd.Run(Testdata+"io.sh", "-")
-	assert.NoError(t, info.Error)
-	assert.Equal(t, expected, out.String())
-	assert.Equal(t, expected, err.String())
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Usr = nobody
+		o.Dir = "/"
+		return o
+	}
+	info := New(opts).Run("id", "-u")
+	assertStart(t, info)
+	assert.Equal(t, nobody.Uid+"\n", out.String())
+	assert.Equal(t, nobody.Uid, strconv.Itoa(info.Uid))
+	assert.Equal(t, "nobody", info.Username)
+
+	ids, err := nobody.GroupIds()
+	assert.NoError(t, err)
+	out.Reset()
+	assertStart(t, New(opts).Run("id", "-G"))
+	want := map[string]bool{nobody.Gid: true}
+	for _, id := range ids {
+		want[id] = true
+	}
+	got := map[string]bool{}
+	for _, id := range strings.Fields(out.String()) {
+		got[id] = true
+	}
+	assert.Equal(t, want, got)
+
+	opts = func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Usr = nobody
+		o.Dir = "/"
+		o.Groups = []uint32{4242}
+		return o
+	}
+	out.Reset()
+	assertStart(t, New(opts).Run("id", "-G"))
+	assert.ElementsMatch(t, []string{nobody.Gid, "4242"}, strings.Fields(out.String()))
 }
 
-func assertTerminate(t *testing.T, info *Info) {
-	assert.Error(t, info.Error)
-	assert.False(t, info.Finished, "info should not be finished")
-	assert.True(t, info.Signaled, "info should be Signaled")
-	assert.Equal(
-		t,
-		15,
-		info.Exit,
-		"should exit with 15")
+func TestMaxCPUTime(t *testing.T) {
+	if _, err := procCPU(os.Getpid()); errors.Is(err, ErrUnsupported) {
+		t.Skip("no cpu time of other processes here")
+	}
+	before := goroutines()
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.MaxCPUTime = 300 * time.Millisecond
+		o.CPUSampleInterval = 50 * time.Millisecond
+		return o
+	}
+	start := time.Now()
+	info := New(opts).Run(Testdata + "spin.sh")
+	assert.Equal(t, ErrCPUTime, info.Error)
+	assert.True(t, info.TimedOut)
+	assert.True(t, info.Signaled)
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	info = New(opts).Run(Testdata+"sleep.sh", "1")
+	assertStart(t, info)
+	assertNoLeaks(t, before)
+}
+
+func TestNice(t *testing.T) {
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Nice = 7
+		return o
+	}
+	cmd := New(opts)
+	cmd.Start("sleep", "5")
+	pid := (<-cmd.Started()).Pid
+	out, err := exec.Command("ps", "-o", "ni=", "-p", strconv.Itoa(pid)).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "7", strings.TrimSpace(string(out)))
+	assert.NoError(t, cmd.Terminate())
+	cmd.Wait()
+
+	opts = func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Nice = -5
+		return o
+	}
+	info := New(opts).Run("true")
+	if os.Geteuid() == 0 {
+		assertStart(t, info)
+	} else {
+		assert.True(t, errors.Is(info.Error, ErrOptions))
+	}
+}
+
+func TestCPUSet(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		opts := func() *Options {
+			o := bufOptions(nil, io.Discard, nil)()
+			o.CPUSet = []int{0}
+			return o
+		}
+		assert.True(t, errors.Is(New(opts).Run("true").Error, ErrUnsupported))
+		return
+	}
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.CPUSet = []int{0}
+		return o
+	}
+	cmd := New(opts)
+	cmd.Start("sleep", "5")
+	pid := (<-cmd.Started()).Pid
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	assert.NoError(t, err)
+	assert.Regexp(t, `Cpus_allowed_list:\s+0\n`, string(status))
+	assert.NoError(t, cmd.Terminate())
+	cmd.Wait()
+
+	opts = func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.CPUSet = []int{1023}
+		return o
+	}
+	info := New(opts).Run("sleep", "5")
+	assert.True(t, errors.Is(info.Error, syscall.EINVAL))
+	assert.Zero(t, info.Pid)
+}
+
+func TestOOMScoreAdj(t *testing.T) {
+	adj := 500
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.OOMScoreAdj = &adj
+		return o
+	}
+	if runtime.GOOS != "linux" {
+		assert.True(t, errors.Is(New(opts).Run("true").Error, ErrUnsupported))
+		return
+	}
+	cmd := New(opts)
+	cmd.Start("sleep", "5")
+	pid := (<-cmd.Started()).Pid
+	score, err := os.ReadFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid))
+	assert.NoError(t, err)
+	assert.Equal(t, "500\n", string(score))
+	assert.NoError(t, cmd.Terminate())
+	cmd.Wait()
+
+	invalid := 5000
+	opts = func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.OOMScoreAdj = &invalid
+		return o
+	}
+	info := New(opts).Run("sleep", "5")
+	assert.True(t, errors.Is(info.Error, syscall.EINVAL))
+}
+
+func TestRlimits(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Rlimits = map[int]syscall.Rlimit{syscall.RLIMIT_NOFILE: {Cur: 64, Max: 128}}
+		return o
+	}
+	if runtime.GOOS != "linux" {
+		// they would limit this process as well
+		assert.True(t, errors.Is(New(opts).Run(Testdata+"rlimit.sh").Error, ErrUnsupported))
+		return
+	}
+	assertStart(t, New(opts).Run(Testdata+"rlimit.sh"))
+	assert.Equal(t, "64\n128\n", out.String())
+
+	opts = func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Rlimits = map[int]syscall.Rlimit{syscall.RLIMIT_NOFILE: {Cur: 128, Max: 64}}
+		return o
+	}
+	info := New(opts).Run(Testdata + "rlimit.sh")
+	assert.True(t, errors.Is(info.Error, syscall.EINVAL))
+	assert.Zero(t, info.Pid)
+}
+
+func TestExtraFiles(t *testing.T) {
+	in, err := os.CreateTemp(t.TempDir(), "in")
+	assert.NoError(t, err)
+	_, err = in.WriteString("from fd 3\n")
+	assert.NoError(t, err)
+	_, err = in.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.ExtraFiles = []*os.File{in}
+		o.NamedFiles = map[string]*os.File{"metrics": w}
+		return o
+	}
+	info := New(opts).Run(Testdata + "fds.sh")
+	assertStart(t, info)
+	assert.Equal(t, 2, info.ExtraFiles)
+	assert.Equal(t, "from fd 3\nfd 4\n", out.String())
+
+	assert.NoError(t, w.Close())
+	metrics, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "metrics\n", string(metrics))
+	assert.NoError(t, in.Close())
+}
+
+func TestDeathSignal(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Getenv("CMDIO_DEATH_HELPER") != "" {
+		// started by the test below, leaves its command behind when it exits
+		cmd := New(bufOptions(nil, io.Discard, nil))
+		cmd.Start("sleep", "30")
+		fmt.Println((<-cmd.Started()).Pid)
+		time.Sleep(100 * time.Millisecond)
+		os.Exit(0)
+	}
+
+	helper := exec.Command(os.Args[0], "-test.run=^TestDeathSignal$")
+	helper.Env = append(os.Environ(), "CMDIO_DEATH_HELPER=1")
+	out, err := helper.Output()
+	assert.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	assert.NoError(t, err)
+
+	if !assert.True(t, exited(pid), "the command outlived the process that started it") {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+func TestUnshare(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Getuid() != 0 {
+		t.Skip("requires root on linux")
+	}
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Unshare = Unshare{PID: true, Mount: true, Net: true, UTS: true}
+		return o
+	}
+	info := New(opts).Run("sh", "-c", "hostname cmdio-test && hostname && echo $$ && tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '")
+	if errors.Is(info.Error, syscall.EPERM) {
+		t.Skip("namespaces are not permitted here")
+	}
+	assertStart(t, info)
+	assert.Equal(t, "cmdio-test\n1\nlo\n", out.String())
+	host, err := os.Hostname()
+	assert.NoError(t, err)
+	assert.NotEqual(t, "cmdio-test", host)
+
+	cmd := New(opts)
+	cmd.Start(Testdata+"sleep.sh", "10")
+	<-cmd.Started()
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, cmd.Terminate())
+	info = cmd.Wait()
+	assert.True(t, info.Signaled)
+	assert.Equal(t, syscall.SIGKILL, info.Signal)
+}
+
+func TestCgroup(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Getuid() != 0 {
+		t.Skip("requires root on linux")
+	}
+	path := fmt.Sprintf("cmdio-test-%d", os.Getpid())
+	lines := make(chan string, 1)
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.CgroupPath = path
+		o.OnStdoutLine = func(line string) { lines <- line }
+		return o
+	}
+	cmd := New(opts)
+	cmd.Start(Testdata + "daemon.sh")
+	daemon, err := strconv.Atoi(<-lines)
+	assert.NoError(t, err)
+	info := cmd.Info()
+	if info.Cgroup == "" {
+		assert.NoError(t, cmd.Terminate())
+		_ = syscall.Kill(daemon, syscall.SIGKILL)
+		t.Skip("cgroup v2 is not mounted")
+	}
+	procs, err := os.ReadFile(filepath.Join(info.Cgroup, "cgroup.procs"))
+	assert.NoError(t, err)
+	assert.Contains(t, strings.Fields(string(procs)), strconv.Itoa(daemon))
+
+	assert.NoError(t, cmd.Terminate())
+	info = *cmd.Wait()
+	assert.True(t, info.Signaled)
+	assert.True(t, exited(daemon), "the daemon outlived the command")
+	_, err = os.Stat(info.Cgroup)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCgroupExists(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Getuid() != 0 {
+		t.Skip("requires root on linux")
+	}
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.CgroupPath = fmt.Sprintf("cmdio-test-exists-%d", os.Getpid())
+		return o
+	}
+	dir := New(opts).Run("true").Cgroup
+	if dir == "" {
+		t.Skip("cgroup v2 is not mounted")
+	}
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	defer syscall.Rmdir(dir)
+
+	info := New(opts).Run("true")
+	assert.True(t, info.StartFailed())
+	assert.True(t, errors.Is(info.Error, os.ErrExist))
+	assert.DirExists(t, dir)
+}
+
+func TestCapabilities(t *testing.T) {
+	info := New(func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.AmbientCaps = []string{"CAP_NET_BIND_SERVICE", "cap_flying"}
+		return o
+	}).Run("true")
+	if runtime.GOOS != "linux" {
+		assert.True(t, errors.Is(info.Error, ErrUnsupported))
+		return
+	}
+	assert.True(t, errors.Is(info.Error, ErrOptions))
+	assert.Contains(t, info.Error.Error(), `"cap_flying"`)
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	out := bytes.NewBufferString("")
+	info = New(func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Usr = nobody
+		o.Dir = "/"
+		o.AmbientCaps = []string{"net_bind_service"}
+		o.DropCaps = []string{"CAP_NET_RAW"}
+		o.NoNewPrivs = true
+		return o
+	}).Run("capsh", "--print")
+	assertStart(t, info)
+	assert.Equal(t, []string{"CAP_NET_BIND_SERVICE"}, info.Caps)
+	assert.Contains(t, out.String(), "Ambient set =cap_net_bind_service\n")
+	assert.Contains(t, out.String(), "no-new-privs=1")
+	assert.NotRegexp(t, "Bounding set =.*cap_net_raw", out.String())
+
+	// the thread that started the command is not reused
+	out.Reset()
+	assertStart(t, New(bufOptions(nil, out, nil)).Run("capsh", "--print"))
+	assert.Regexp(t, "Bounding set =.*cap_net_raw", out.String())
+	assert.Contains(t, out.String(), "no-new-privs=0")
+}
+
+func TestUmask(t *testing.T) {
+	dir := t.TempDir()
+	mask := 0o077
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Umask = &mask
+		return o
+	}
+	assertStart(t, New(opts).Run("touch", filepath.Join(dir, "private")))
+	st, err := os.Stat(filepath.Join(dir, "private"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), st.Mode().Perm())
+
+	old := syscall.Umask(0o022)
+	defer syscall.Umask(old)
+	assertStart(t, New(bufOptions(nil, io.Discard, nil)).Run("touch", filepath.Join(dir, "shared")))
+	st, err = os.Stat(filepath.Join(dir, "shared"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), st.Mode().Perm())
+}
+
+func TestChroot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("requires go to build the chroot")
+	}
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "work"), 0755))
+	build := exec.Command("go", "build", "-o", filepath.Join(root, "bin", "pwd"), Testdata+"chroot/pwd.go")
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+	out, err := build.CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	buf := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, buf, nil)()
+		o.Chroot = root
+		o.Dir = "/work"
+		return o
+	}
+	complete, err := New(opts).StartE("/bin/pwd")
+	assert.NoError(t, err)
+	<-complete
+	info := New(opts).Run("/bin/pwd")
+	assertStart(t, info)
+	assert.Equal(t, "/work false\n/work false\n", buf.String())
+
+	opts = func() *Options {
+		o := bufOptions(nil, buf, nil)()
+		o.Chroot = filepath.Join(root, "missing")
+		return o
+	}
+	_, err = New(opts).StartE("/bin/pwd")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Contains(t, err.Error(), "chroot")
+}
+
+func TestProcessGroup(t *testing.T) {
+	sid := func(pid int) string {
+		out, err := exec.Command("ps", "-o", "sid=", "-p", strconv.Itoa(pid)).Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+	for _, mode := range []ProcessGroup{Session, NewGroup, Inherit} {
+		opts := func() *Options {
+			o := bufOptions(nil, io.Discard, nil)()
+			o.ProcessGroup = mode
+			return o
+		}
+		cmd := New(opts)
+		cmd.Start("sleep", "5")
+		pid := (<-cmd.Started()).Pid
+		pgid, err := syscall.Getpgid(pid)
+		assert.NoError(t, err)
+
+		switch mode {
+		case Session:
+			assert.Equal(t, pid, pgid)
+			assert.Equal(t, strconv.Itoa(pid), sid(pid))
+		case NewGroup:
+			assert.Equal(t, pid, pgid)
+			assert.Equal(t, sid(os.Getpid()), sid(pid))
+		case Inherit:
+			assert.Equal(t, syscall.Getpgrp(), pgid)
+			assert.Equal(t, sid(os.Getpid()), sid(pid))
+		}
+
+		assert.NoError(t, cmd.Terminate())
+		assertTerminate(t, cmd.Wait())
+	}
+}
+
+func TestChildren(t *testing.T) {
+	if _, err := children(os.Getpid()); errors.Is(err, ErrUnsupported) {
+		t.Skip("children are not known here")
+	}
+	lines := make(chan string, 1)
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.ProcessGroup = Inherit
+		o.OnStdoutLine = func(line string) { lines <- line }
+		return o
+	}
+	cmd := New(opts)
+	cmd.Start("sh", "-c", "sleep 30 & echo $!; wait")
+	pid := (<-cmd.Started()).Pid
+	child, err := strconv.Atoi(<-lines)
+	assert.NoError(t, err)
+
+	ch, err := children(pid)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{child}, ch)
+
+	// the command shares the group of this process, its children lead no
+	// group of their own and are signaled one by one
+	pgid, err := syscall.Getpgid(child)
+	assert.NoError(t, err)
+	assert.Equal(t, syscall.Getpgrp(), pgid)
+	assert.NoError(t, cmd.Terminate())
+	assertTerminate(t, cmd.Wait())
+	if !assert.True(t, exited(child), "the child outlived the command") {
+		_ = syscall.Kill(child, syscall.SIGKILL)
+	}
+}
+
+func TestChildrenOfProcess(t *testing.T) {
+	if _, err := children(os.Getpid()); errors.Is(err, ErrUnsupported) {
+		t.Skip("children are not known here")
+	}
+	child := exec.Command("sleep", "5")
+	assert.NoError(t, child.Start())
+	defer func() {
+		_ = child.Process.Kill()
+		_ = child.Wait()
+	}()
+
+	ch, err := children(os.Getpid())
+	assert.NoError(t, err)
+	assert.Contains(t, ch, child.Process.Pid)
+	for _, pid := range ch {
+		ppid, err := exec.Command("ps", "-o", "ppid=", "-p", strconv.Itoa(pid)).Output()
+		if err != nil {
+			// exited since
+			continue
+		}
+		assert.Equal(t, strconv.Itoa(os.Getpid()), strings.TrimSpace(string(ppid)), "pid %d", pid)
+	}
+}
+
+func TestState(t *testing.T) {
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	assert.Equal(t, Created, cmd.State())
+	cmd.Start(Testdata+"sleep.sh", "10")
+	<-cmd.Started()
+	assert.Equal(t, Running, cmd.State())
+	assert.Equal(t, Running, cmd.Info().State)
+	assert.NoError(t, cmd.Terminate())
+	// signaled until it has exited
+	assert.Contains(t, []State{Signaled, Terminated}, cmd.State())
+	info := cmd.Wait()
+	assert.Equal(t, Terminated, info.State)
+	assert.Equal(t, ReasonTerminated, info.Reason)
+	assert.True(t, info.Finished)
+	assert.Equal(t, Terminated, cmd.State())
+
+	cmd = New(bufOptions(nil, io.Discard, nil))
+	cmd.Start(Testdata+"sleep.sh", "10")
+	<-cmd.Started()
+	assert.NoError(t, cmd.Kill())
+	assert.Contains(t, []State{Killed, Terminated}, cmd.State())
+	info = cmd.Wait()
+	assert.Equal(t, Terminated, info.State)
+	assert.Equal(t, ReasonKilled, info.Reason)
+	assert.True(t, info.Finished)
+
+	assert.Equal(t, Exited, New(bufOptions(nil, io.Discard, nil)).Run("true").State)
+
+	names := map[State]string{Created: "created", Running: "running", Exited: "exited", Signaled: "signaled", Killed: "killed", Terminated: "terminated", 42: "State(42)"}
+	for state, name := range names {
+		assert.Equal(t, name, state.String())
+	}
+}
+
+func TestIsRunningAndPid(t *testing.T) {
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	assert.False(t, cmd.IsRunning())
+	_, ok := cmd.Pid()
+	assert.False(t, ok)
+
+	done := make(chan struct{})
+	go func() {
+		// polls across the start and exit of the command
+		defer close(done)
+		for cmd.State() != Exited {
+			if pid, ok := cmd.Pid(); ok {
+				assert.True(t, pid > 0)
+			}
+			_ = cmd.IsRunning()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	cmd.Start(Testdata+"sleep.sh", "1")
+	r := <-cmd.Started()
+	assert.True(t, cmd.IsRunning())
+	pid, ok := cmd.Pid()
+	assert.True(t, ok)
+	assert.Equal(t, r.Pid, pid)
+
+	assertStart(t, cmd.Wait())
+	<-done
+	assert.False(t, cmd.IsRunning())
+	pid, ok = cmd.Pid()
+	assert.True(t, ok)
+	assert.Equal(t, r.Pid, pid)
+
+	cmd = New(bufOptions(nil, io.Discard, nil))
+	cmd.Start("/nonexistent/command")
+	<-cmd.Started()
+	cmd.Wait()
+	assert.False(t, cmd.IsRunning())
+	_, ok = cmd.Pid()
+	assert.False(t, ok)
+}
+
+func TestInfoNameArgs(t *testing.T) {
+	args := []string{"-c", "exit 0"}
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	cmd.Start("sh", args...)
+	args[1] = "changed"
+	info := cmd.Wait()
+	assertStart(t, info)
+	assert.Equal(t, "sh", info.Name)
+	assert.Equal(t, []string{"-c", "exit 0"}, info.Args)
+
+	info = New(func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.OmitArgs = true
+		return o
+	}).Run("echo", "secret")
+	assertStart(t, info)
+	assert.Equal(t, "echo", info.Name)
+	assert.Nil(t, info.Args)
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestInfoJSON(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 123456789, time.UTC)
+	infos := map[string]Info{
+		"info_exited": {
+			Name:        "sh",
+			Args:        []string{"-c", "exit 3"},
+			State:       Exited,
+			Reason:      ReasonExited,
+			Pid:         1234,
+			Exit:        3,
+			Error:       errors.New("exit status 3"),
+			StartT:      start.UnixNano(),
+			EndT:        start.Add(1200 * time.Millisecond).UnixNano(),
+			RunT:        1200 * time.Millisecond,
+			UserTime:    800 * time.Millisecond,
+			SystemTime:  100 * time.Millisecond,
+			MaxRSS:      3 << 20,
+			Finished:    true,
+			Attempts:    1,
+			Uid:         1000,
+			Gid:         1000,
+			Username:    "build",
+			Tail:        []string{"done"},
+			StdoutBytes: 5,
+		},
+		"info_signaled": {
+			Name:     "sleep",
+			Args:     []string{"10"},
+			State:    Terminated,
+			Reason:   ReasonTimedOut,
+			Pid:      4321,
+			Exit:     -1,
+			Signal:   syscall.SIGTERM,
+			Error:    ErrTimeout,
+			StartT:   start.UnixNano(),
+			EndT:     start.Add(time.Second).UnixNano(),
+			RunT:     time.Second,
+			Finished: true,
+			Signaled: true,
+			TimedOut: true,
+			Attempts: 2,
+		},
+		"info_created": {Name: "true"},
+	}
+	for name, info := range infos {
+		b, err := json.MarshalIndent(info, "", "  ")
+		assert.NoError(t, err)
+		golden := Testdata + name + ".golden.json"
+		if *update {
+			assert.NoError(t, os.WriteFile(golden, append(b, '\n'), 0o644))
+		}
+		want, err := os.ReadFile(golden)
+		assert.NoError(t, err)
+		assert.Equal(t, string(want), string(b)+"\n", name)
+
+		var back Info
+		assert.NoError(t, json.Unmarshal(want, &back))
+		// errors come back with their messages only
+		if info.Error != nil {
+			assert.Equal(t, info.Error.Error(), back.Error.Error())
+		}
+		info.Error, back.Error = nil, nil
+		assert.Equal(t, info, back, name)
+	}
+
+	var info Info
+	assert.Error(t, json.Unmarshal([]byte(`{"state":"unknown"}`), &info))
+	assert.Error(t, json.Unmarshal([]byte(`{"started_at":"yesterday"}`), &info))
+}
+
+func TestInfoString(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for want, info := range map[string]Info{
+		"name=true state=created": {Name: "true"},
+		`name=nope state=exited reason=start_failed error="exec: \"nope\": executable file not found in $PATH"`: {
+			Name: "nope", State: Exited, Reason: ReasonStartFailed, Error: errors.New(`exec: "nope": executable file not found in $PATH`), StartT: start.UnixNano(),
+		},
+		"name=sh state=exited reason=exited pid=1234 exit=0 signaled=false runtime=1.2s started=2024-05-01T10:00:00Z": {
+			Name: "sh", State: Exited, Reason: ReasonExited, Pid: 1234, RunT: 1200 * time.Millisecond, StartT: start.UnixNano(), Finished: true,
+		},
+		`name=sleep state=terminated pid=4321 exit=-1 signaled=true signal=15 timed_out=true runtime=1s started=2024-05-01T10:00:00Z error="timeout exceeded"`: {
+			Name: "sleep", State: Terminated, Pid: 4321, Exit: -1, Signal: syscall.SIGTERM, Signaled: true, TimedOut: true,
+			RunT: time.Second, StartT: start.UnixNano(), Error: errors.New("timeout exceeded"),
+		},
+		`name="my tool" state=running pid=7 exit=0 signaled=false runtime=0s started=2024-05-01T10:00:00Z`: {
+			Name: "my tool", State: Running, Pid: 7, StartT: start.UnixNano(),
+		},
+	} {
+		assert.Equal(t, want, info.String())
+	}
+}
+
+func TestExitAndSignal(t *testing.T) {
+	info := New(bufOptions(nil, io.Discard, nil)).Run("sh", "-c", "exit 15")
+	assert.Equal(t, 15, info.Exit)
+	assert.Equal(t, syscall.Signal(0), info.Signal)
+	assert.False(t, info.Signaled)
+
+	info = New(bufOptions(nil, io.Discard, nil)).Run("sh", "-c", "kill -TERM $$")
+	assert.Equal(t, -1, info.Exit)
+	assert.Equal(t, syscall.SIGTERM, info.Signal)
+	assert.True(t, info.Signaled)
+}
+
+func TestExitCodeConvention(t *testing.T) {
+	for conv, want := range map[ExitCodeConvention]int{
+		GoExitCode:    -1,
+		RawExitCode:   int(syscall.SIGTERM),
+		ShellExitCode: 128 + int(syscall.SIGTERM),
+	} {
+		opts := func() *Options {
+			o := bufOptions(nil, io.Discard, nil)()
+			o.ExitCodeConvention = conv
+			return o
+		}
+		info := run("selfterm.sh", opts)
+		assert.Equal(t, want, info.Exit, "convention %d", conv)
+		assert.Equal(t, syscall.SIGTERM, info.Signal)
+		assert.True(t, info.Signaled)
+
+		// exit statuses are reported as they are
+		info = New(opts).Run("sh", "-c", "exit 3")
+		assert.Equal(t, 3, info.Exit)
+	}
+
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.ExitCodeConvention = ShellExitCode + 1
+		return o
+	}
+	assert.True(t, errors.Is(New(opts).Run("true").Error, ErrOptions))
+}
+
+func TestInfoStream(t *testing.T) {
+	before := goroutines()
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	fast := cmd.InfoStream(50 * time.Millisecond)
+	slow := cmd.InfoStream(time.Hour)
+	abandoned := cmd.InfoStream(10 * time.Millisecond)
+	_, done := cmd.Start("sleep", "0.5")
+
+	var infos []Info
+	for info := range fast {
+		infos = append(infos, info)
+	}
+	final := <-done
+	assert.GreaterOrEqual(t, len(infos), 3)
+	for _, info := range infos[:len(infos)-1] {
+		assert.Equal(t, Running, info.State)
+		assert.Equal(t, final.Pid, info.Pid)
+	}
+	last := infos[len(infos)-1]
+	assert.Equal(t, Exited, last.State)
+	assert.Equal(t, final.RunT, last.RunT)
+
+	// the streams are independent, one that never ticked still completes
+	infos = nil
+	for info := range slow {
+		infos = append(infos, info)
+	}
+	assert.Len(t, infos, 1)
+	assert.Equal(t, Exited, infos[0].State)
+
+	// the goroutines exit although nobody reads abandoned, the final Info
+	// replaced the snapshot it held
+	assertNoLeaks(t, before)
+	assert.Equal(t, Exited, (<-abandoned).State)
+	_, ok := <-abandoned
+	assert.False(t, ok)
+}
+
+func TestInfoStreamClosed(t *testing.T) {
+	before := goroutines()
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	// an interval that is not positive falls back to the default
+	stream := cmd.InfoStream(0)
+	assert.NoError(t, cmd.Close())
+
+	// a command that never started completes its streams once closed
+	assertNoLeaks(t, before)
+	assert.Equal(t, ErrClosed, (<-stream).Error)
+	_, ok := <-stream
+	assert.False(t, ok)
+}
+
+func TestTerminateFailure(t *testing.T) {
+	deny := int32(syscall.EPERM)
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	cmd.kil = func(pid int, sig syscall.Signal) error {
+		if e := atomic.LoadInt32(&deny); e != 0 {
+			return syscall.Errno(e)
+		}
+		return kill(pid, sig)
+	}
+	events := cmd.Subscribe()
+	_, done := cmd.Start("sleep", "10")
+	<-cmd.Started()
+
+	for _, stop := range []func() error{cmd.Terminate, cmd.Kill} {
+		err := stop()
+		assert.True(t, errors.Is(err, syscall.EPERM))
+		assert.Equal(t, Running, cmd.State())
+		info := cmd.Info()
+		assert.False(t, info.Signaled)
+		assert.False(t, info.Killed)
+	}
+
+	// the process is reported gone, nothing was signaled
+	atomic.StoreInt32(&deny, int32(syscall.ESRCH))
+	for _, stop := range []func() error{cmd.Terminate, cmd.Kill} {
+		assert.NoError(t, stop())
+		assert.Equal(t, Running, cmd.State())
+		info := cmd.Info()
+		assert.False(t, info.Signaled)
+		assert.False(t, info.Killed)
+	}
+
+	atomic.StoreInt32(&deny, 0)
+	assert.NoError(t, cmd.Terminate())
+	info := <-done
+	assert.True(t, info.Finished)
+	assert.Equal(t, Terminated, info.State)
+	assert.Equal(t, ReasonTerminated, info.Reason)
+
+	var signaled []syscall.Signal
+	for _, event := range collect(events) {
+		if e, ok := event.(SignaledEvent); ok {
+			signaled = append(signaled, e.Signal)
+		}
+	}
+	assert.Equal(t, []syscall.Signal{syscall.SIGTERM}, signaled)
+}
+
+func TestPgid(t *testing.T) {
+	for group, want := range map[ProcessGroup]func(pid int) int{
+		Session:  func(pid int) int { return pid },
+		NewGroup: func(pid int) int { return pid },
+		Inherit:  func(int) int { return syscall.Getpgrp() },
+	} {
+		opts := func() *Options {
+			o := bufOptions(nil, io.Discard, nil)()
+			o.ProcessGroup = group
+			return o
+		}
+		cmd := New(opts)
+		_, done := cmd.Start("sleep", "10")
+		<-cmd.Started()
+		info := cmd.Info()
+		assert.Equal(t, want(info.Pid), info.Pgid, "group %d", group)
+		assert.NoError(t, cmd.Terminate())
+		assert.Equal(t, info.Pgid, (<-done).Pgid)
+	}
+
+	// the group can be signaled from outside
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	_, done := cmd.Start("sh", "-c", "sleep 10 & wait")
+	<-cmd.Started()
+	assert.NoError(t, syscall.Kill(-cmd.Info().Pgid, syscall.SIGKILL))
+	assert.Equal(t, syscall.SIGKILL, (<-done).Signal)
+
+	info := New(bufOptions(nil, io.Discard, nil)).Run("cmdio-no-such-command")
+	assert.Equal(t, 0, info.Pgid)
+}
+
+func collect(ch <-chan Event) []Event {
+	var events []Event
+	for e := range ch {
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestSubscribe(t *testing.T) {
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	first, second := cmd.Subscribe(), cmd.Subscribe()
+	_, done := cmd.Start("sleep", "10")
+	assert.NoError(t, <-cmd.Ready())
+	assert.NoError(t, cmd.Terminate())
+	info := <-done
+
+	events := collect(first)
+	assert.Equal(t, events, collect(second))
+	assert.Len(t, events, 4)
+	started := events[0].(StartedEvent)
+	assert.Equal(t, info.Pid, started.Pid)
+	assert.Equal(t, 1, started.Attempt)
+	assert.Equal(t, info.Pid, events[1].(ReadyEvent).Pid)
+	assert.Equal(t, syscall.SIGTERM, events[2].(SignaledEvent).Signal)
+	assert.Equal(t, info, events[3].(ExitedEvent).Info)
+	for i := 1; i < len(events); i++ {
+		assert.False(t, events[i].Time().Before(events[i-1].Time()))
+	}
+
+	// a late subscriber gets the ExitedEvent only
+	events = collect(cmd.Subscribe())
+	assert.Len(t, events, 1)
+	assert.Equal(t, info, events[0].(ExitedEvent).Info)
+
+	cmd = New(bufOptions(nil, io.Discard, nil))
+	sub := cmd.Subscribe()
+	policy := RetryPolicy{MaxAttempts: 2, Delay: 10 * time.Millisecond}
+	info = *cmd.RunWithRetry(policy, "sh", "-c", "exit 1")
+	events = collect(sub)
+	assert.Len(t, events, 5)
+	assert.IsType(t, ReadyEvent{}, events[1])
+	restart := events[2].(RestartScheduledEvent)
+	assert.Equal(t, 2, restart.Attempt)
+	assert.Equal(t, 10*time.Millisecond, restart.Delay)
+	assert.Equal(t, 1, restart.Info.Exit)
+	assert.Equal(t, 2, events[3].(StartedEvent).Attempt)
+	assert.Equal(t, info, events[4].(ExitedEvent).Info)
+
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.MaxOutputBytes = 10
+		return o
+	}
+	cmd = New(opts)
+	sub = cmd.Subscribe()
+	cmd.Run(Testdata+"ticker.sh", "3")
+	events = collect(sub)
+	assert.Len(t, events, 4)
+	assert.IsType(t, OutputTruncatedEvent{}, events[2])
+
+	// terminating a kept alive command schedules no restart
+	cmd = New(func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.KeepAlive = &KeepAlive{}
+		return o
+	})
+	sub = cmd.Subscribe()
+	_, done = cmd.Start("sleep", "10")
+	assert.NoError(t, <-cmd.Ready())
+	assert.NoError(t, cmd.Terminate())
+	<-done
+	for _, event := range collect(sub) {
+		_, restart := event.(RestartScheduledEvent)
+		assert.False(t, restart)
+	}
+}
+
+func TestSubscribeSlow(t *testing.T) {
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	slow := cmd.Subscribe()
+	_, done := cmd.Start("sleep", "10")
+	assert.NoError(t, <-cmd.Ready())
+	// more events than the buffer holds, none of them blocks
+	for i := 0; i < 2*eventBuffer; i++ {
+		assert.NoError(t, cmd.Signal(syscall.SIGCONT))
+	}
+	assert.NoError(t, cmd.Kill())
+	info := <-done
+
+	events := collect(slow)
+	assert.Len(t, events, eventBuffer)
+	// the ExitedEvent took the place of the oldest event
+	assert.IsType(t, ReadyEvent{}, events[0])
+	assert.Equal(t, info, events[len(events)-1].(ExitedEvent).Info)
+}
+
+// writeLog records every Write call
+type writeLog struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (w *writeLog) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestEventLog(t *testing.T) {
+	log := &writeLog{}
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.EventLog = log
+		return o
+	}
+	var wg sync.WaitGroup
+	for _, args := range [][]string{{"sh", "-c", "exit 2"}, {"sleep", "0.1"}} {
+		wg.Add(1)
+		go func(args []string) {
+			defer wg.Done()
+			New(opts).Run(args[0], args[1:]...)
+		}(args)
+	}
+	cmd := New(opts)
+	_, done := cmd.Start("sleep", "10")
+	assert.NoError(t, <-cmd.Ready())
+	assert.NoError(t, cmd.Terminate())
+	<-done
+	wg.Wait()
+
+	events := map[string][]string{}
+	for _, w := range log.writes {
+		// one record per write
+		assert.True(t, strings.HasSuffix(w, "\n"))
+		assert.Equal(t, 1, strings.Count(w, "\n"))
+		var r map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(w), &r))
+		_, err := time.Parse(time.RFC3339Nano, r["time"].(string))
+		assert.NoError(t, err)
+		key := fmt.Sprintf("%s %v", r["name"], r["pid"])
+		assert.Equal(t, float64(len(events[key])+1), r["seq"], w)
+		events[key] = append(events[key], r["event"].(string))
+		if r["event"] == "exit" && r["name"] == "sh" {
+			assert.Equal(t, float64(2), r["exit"])
+			assert.Equal(t, "exited", r["reason"])
+		}
+	}
+	assert.Len(t, events, 3)
+	var seen []string
+	for _, names := range events {
+		seen = append(seen, strings.Join(names, ","))
+	}
+	assert.ElementsMatch(t, []string{"start,ready,exit", "start,ready,exit", "start,ready,signal,exit"}, seen)
+}
+
+// stalledLog calls back into its command and blocks until it is released
+type stalledLog struct {
+	cmd     *CmdIo
+	release chan struct{}
+}
+
+func (w *stalledLog) Write(p []byte) (int, error) {
+	w.cmd.Info()
+	<-w.release
+	return len(p), nil
+}
+
+func TestEventLogStalled(t *testing.T) {
+	log := &stalledLog{release: make(chan struct{})}
+	log.cmd = New(func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.EventLog = log
+		return o
+	})
+	_, done := log.cmd.Start("sleep", "10")
+	assert.NoError(t, <-log.cmd.Ready())
+
+	// neither stalls while the log does
+	stopped := make(chan error, 1)
+	go func() {
+		log.cmd.Info()
+		stopped <- log.cmd.Terminate()
+	}()
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event log stalled the command")
+	}
+	close(log.release)
+	assert.True(t, (<-done).Signaled)
+}
+
+// handlers counts the goroutines running signalHandler
+func handlers() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return strings.Count(string(buf), "cmdio.signalHandler(")
+}
+
+func TestSignalHandlerOnce(t *testing.T) {
+	var cmds []*CmdIo
+	var dones []<-chan Info
+	for i := 0; i < 50; i++ {
+		cmd := New(bufOptions(nil, io.Discard, nil))
+		_, done := cmd.Start("sleep", "10")
+		cmds = append(cmds, cmd)
+		dones = append(dones, done)
+	}
+	for _, cmd := range cmds {
+		<-cmd.Started()
+	}
+	assert.Equal(t, 1, handlers())
+	for i, cmd := range cmds {
+		assert.NoError(t, cmd.Kill())
+		<-dones[i]
+	}
+}
+
+func TestDisableSignalHandling(t *testing.T) {
+	if when := os.Getenv("CMDIO_UNHANDLE_HELPER"); when != "" {
+		// started by the test below, disabling can not be undone
+		if when == "before" {
+			DisableSignalHandling()
+		}
+		touched := filepath.Join(os.Getenv("CMDIO_UNHANDLE_DIR"), "winch")
+		cmd := New(bufOptions(nil, io.Discard, nil))
+		_, done := cmd.Start("bash", "-c", `trap 'touch "$0"; exit 0' WINCH; sleep 10 >/dev/null 2>&1 & wait`, touched)
+		<-cmd.Started()
+		if when == "after" {
+			DisableSignalHandling()
+		}
+		// give the script time to install its trap
+		time.Sleep(200 * time.Millisecond)
+		_ = syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+		time.Sleep(200 * time.Millisecond)
+		_, err := os.Stat(touched)
+		fmt.Println(handlers(), os.IsNotExist(err))
+		_ = cmd.Kill()
+		<-done
+		os.Exit(0)
+	}
+
+	for _, when := range []string{"before", "after"} {
+		helper := exec.Command(os.Args[0], "-test.run=^TestDisableSignalHandling$")
+		helper.Env = append(os.Environ(), "CMDIO_UNHANDLE_HELPER="+when, "CMDIO_UNHANDLE_DIR="+t.TempDir())
+		out, err := helper.Output()
+		assert.NoError(t, err, when)
+		assert.Equal(t, "0 true\n", string(out), when)
+	}
+}
+
+func TestSignalForwarding(t *testing.T) {
+	// a child this package does not manage
+	other := exec.Command("sleep", "10")
+	other.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	assert.NoError(t, other.Start())
+	defer func() {
+		_ = other.Process.Kill()
+		_ = other.Wait()
+	}()
+
+	// SIGWINCH is forwarded and does not end this process
+	touched := filepath.Join(t.TempDir(), "winch")
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	_, done := cmd.Start("bash", "-c", `trap 'touch "$0"; exit 0' WINCH; sleep 10 >/dev/null 2>&1 & wait`, touched)
+	<-cmd.Started()
+	// give the script time to install its trap
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGWINCH))
+
+	select {
+	case info := <-done:
+		assert.NoError(t, info.Error)
+		assert.FileExists(t, touched)
+	case <-time.After(5 * time.Second):
+		_ = cmd.Kill()
+		t.Fatal("the signal was not forwarded")
+	}
+	assert.NoError(t, other.Process.Signal(syscall.Signal(0)), "the other child was signaled")
+}
+
+func TestSignalRaised(t *testing.T) {
+	if touched := os.Getenv("CMDIO_RAISE_HELPER"); touched != "" {
+		// started by the test below, ended by the SIGTERM it sends itself
+		cmd := New(bufOptions(nil, io.Discard, nil))
+		cmd.Start("bash", "-c", `trap 'touch "$0"; exit 0' TERM; sleep 10 & wait`, touched)
+		<-cmd.Started()
+		time.Sleep(200 * time.Millisecond)
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		time.Sleep(2 * time.Second)
+		fmt.Println("survived")
+		os.Exit(0)
+	}
+
+	touched := filepath.Join(t.TempDir(), "term")
+	helper := exec.Command(os.Args[0], "-test.run=^TestSignalRaised$")
+	helper.Env = append(os.Environ(), "CMDIO_RAISE_HELPER="+touched)
+	out, err := helper.Output()
+	assert.Empty(t, string(out))
+	var exit *exec.ExitError
+	if assert.True(t, errors.As(err, &exit)) {
+		assert.Equal(t, syscall.SIGTERM, exit.Sys().(syscall.WaitStatus).Signal())
+	}
+	// the command got the signal before this process ended
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(touched); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.FileExists(t, touched)
+}
+
+func TestReason(t *testing.T) {
+	timeout := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Timeout = 200 * time.Millisecond
+		return o
+	}
+	for _, tc := range []struct {
+		want Reason
+		opts func() *Options
+		args []string
+		stop func(*CmdIo) error
+	}{
+		{ReasonStartFailed, bufOptions(nil, io.Discard, nil), []string{"cmdio-no-such-command"}, nil},
+		{ReasonExited, bufOptions(nil, io.Discard, nil), []string{"sh", "-c", "exit 3"}, nil},
+		{ReasonSignaled, bufOptions(nil, io.Discard, nil), []string{"sh", "-c", "kill -TERM $$"}, nil},
+		{ReasonTimedOut, timeout, []string{"sleep", "10"}, nil},
+		{ReasonTerminated, bufOptions(nil, io.Discard, nil), []string{"sleep", "10"}, (*CmdIo).Terminate},
+		{ReasonKilled, bufOptions(nil, io.Discard, nil), []string{"sleep", "10"}, (*CmdIo).Kill},
+		{ReasonSignaled, bufOptions(nil, io.Discard, nil), []string{"sleep", "10"}, func(c *CmdIo) error {
+			return c.Signal(syscall.SIGTERM)
+		}},
+	} {
+		cmd := New(tc.opts)
+		started, done := cmd.Start(tc.args[0], tc.args[1:]...)
+		<-started
+		if tc.stop != nil {
+			assert.NoError(t, tc.stop(cmd))
+		}
+		info := <-done
+		assert.Equal(t, tc.want, info.Reason, tc.want.String())
+	}
+
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	assert.Equal(t, ReasonNone, cmd.Info().Reason)
+	assert.NoError(t, cmd.Close())
+	assert.Equal(t, ReasonStartFailed, cmd.Run("true").Reason)
+
+	assert.Equal(t, "Reason(42)", Reason(42).String())
+}
+
+func TestStartError(t *testing.T) {
+	info := New(bufOptions(nil, io.Discard, nil)).Run("cmdio-no-such-command")
+	var se *StartError
+	assert.True(t, errors.As(info.Error, &se))
+	assert.True(t, errors.Is(info.Error, exec.ErrNotFound))
+	assert.Equal(t, -1, info.Exit)
+	assert.True(t, info.Finished)
+
+	// not even root may execute a file without execute bits
+	script := filepath.Join(t.TempDir(), "script.sh")
+	assert.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0o644))
+	info = New(bufOptions(nil, io.Discard, nil)).Run(script)
+	assert.True(t, errors.As(info.Error, &se))
+	assert.True(t, errors.Is(info.Error, os.ErrPermission))
+
+	info = New(bufOptions(nil, io.Discard, nil)).Run("sh", "-c", "exit 3")
+	assert.False(t, errors.As(info.Error, &se))
+	assert.Equal(t, 3, info.Exit)
+}
+
+func TestStartFailedInfo(t *testing.T) {
+	info := New(bufOptions(nil, io.Discard, nil)).Run("cmdio-no-such-command")
+	assert.True(t, info.StartFailed())
+	assert.Equal(t, -1, info.Exit)
+	assert.Equal(t, 0, info.Pid)
+	assert.Equal(t, time.Duration(0), info.RunT)
+	assert.True(t, info.Finished)
+	assert.Equal(t, Exited, info.State)
+
+	// the second attempt finds the script gone
+	script := filepath.Join(t.TempDir(), "once.sh")
+	assert.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\nsleep 0.1\nexit 1\n"), 0o755))
+	policy := RetryPolicy{MaxAttempts: 2, Retry: func(i Info) bool {
+		_ = os.Remove(script)
+		return true
+	}}
+	info = New(bufOptions(nil, io.Discard, nil)).RunWithRetry(policy, script)
+	assert.Equal(t, 2, info.Attempts)
+	assert.True(t, info.StartFailed())
+	assert.Equal(t, -1, info.Exit)
+	assert.Equal(t, 0, info.Pid)
+	assert.Equal(t, time.Duration(0), info.RunT)
+
+	info = New(bufOptions(nil, io.Discard, nil)).Run("true")
+	assert.False(t, info.StartFailed())
+}
+
+func TestRunT(t *testing.T) {
+	info := New(bufOptions(nil, io.Discard, nil)).Run("sleep", "0.5")
+	assert.NoError(t, info.Error)
+	assert.GreaterOrEqual(t, int64(info.RunT), int64(500*time.Millisecond))
+	assert.Less(t, int64(info.RunT), int64(3*time.Second))
+	assert.InDelta(t, int64(info.RunT), info.EndT-info.StartT, float64(time.Millisecond))
+
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	_, done := cmd.Start("sleep", "0.5")
+	res := <-cmd.Started()
+	time.Sleep(100 * time.Millisecond)
+	running := cmd.Info().RunT
+	assert.GreaterOrEqual(t, int64(running), int64(100*time.Millisecond))
+	assert.Less(t, int64(running), int64(500*time.Millisecond))
+	final := <-done
+	assert.Greater(t, int64(final.RunT), int64(running))
+	// StartT is the start of the attempt, written once
+	assert.Equal(t, res.StartedAt.UnixNano(), final.StartT)
+}
+
+func TestRusage(t *testing.T) {
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Timeout = 500 * time.Millisecond
+		return o
+	}
+	info := New(opts).Run(Testdata + "spin.sh")
+	assert.True(t, info.TimedOut)
+	assert.Greater(t, int64(info.UserTime), int64(100*time.Millisecond))
+	assert.LessOrEqual(t, int64(info.UserTime+info.SystemTime), int64(info.RunT))
+	// a shell needs more than a page and less than a gigabyte
+	assert.Greater(t, info.MaxRSS, int64(64<<10))
+	assert.Less(t, info.MaxRSS, int64(1<<30))
+
+	info = New(bufOptions(nil, io.Discard, nil)).Run("cmdio-no-such-command")
+	assert.Equal(t, time.Duration(0), info.UserTime)
+	assert.Equal(t, time.Duration(0), info.SystemTime)
+	assert.Equal(t, int64(0), info.MaxRSS)
+}
+
+func TestIOBytes(t *testing.T) {
+	if _, err := os.Stat("/proc/self/io"); err != nil {
+		t.Skip("no /proc/<pid>/io")
+	}
+	// the temporary directory may be a tmpfs, which has no storage
+	dir, err := os.MkdirTemp(".", "io")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	info := New(bufOptions(nil, io.Discard, nil)).Run("sh", "-c",
+		"dd if=/dev/zero of="+filepath.Join(dir, "out")+" bs=1M count=4 2>/dev/null")
+	assert.NoError(t, info.Error)
+	assert.GreaterOrEqual(t, info.IOWriteBytes, int64(4<<20))
+
+	info = New(bufOptions(nil, io.Discard, nil)).Run("true")
+	assert.Equal(t, int64(0), info.IOWriteBytes)
+}
+
+func TestSentinels(t *testing.T) {
+	opts := bufOptions(nil, io.Discard, nil)
+	finished := func() *CmdIo {
+		cmd := New(opts)
+		cmd.Run("true")
+		return cmd
+	}
+	closed := func() *CmdIo {
+		cmd := New(opts)
+		_ = cmd.Close()
+		return cmd
+	}
+	for _, tc := range []struct {
+		name string
+		want error
+		err  func() error
+	}{
+		{"Run reused", ErrReused, func() error { return finished().Run("true").Error }},
+		{"StartE reused", ErrReused, func() error { _, e := finished().StartE("true"); return e }},
+		{"Start reused", ErrReused, func() error { _, ch := finished().Start("true"); return (<-ch).Error }},
+		{"Run closed", ErrClosed, func() error { return closed().Run("true").Error }},
+		{"Close closed", ErrClosed, func() error { return closed().Close() }},
+		{"Wait not started", ErrNotStarted, func() error { return New(opts).Wait().Error }},
+		{"Terminate not started", ErrNotStarted, func() error { return New(opts).Terminate() }},
+		{"Signal not started", ErrNotStarted, func() error { return New(opts).Signal(syscall.SIGTERM) }},
+		{"Signal finished", ErrAlreadyFinished, func() error { return finished().Signal(syscall.SIGTERM) }},
+		{"Run missing command", ErrStartFailed, func() error { return New(opts).Run("cmdio-no-such-command").Error }},
+		{"Run empty name", ErrNoCommand, func() error { return New(opts).Run("").Error }},
+		{"StdoutPipe twice", ErrOptions, func() error {
+			cmd := New(bufOptions(nil, nil, nil))
+			stdout, _ := cmd.StdoutPipe()
+			defer stdout.Close()
+			_, e := cmd.StdoutPipe()
+			return e
+		}},
+		{"StdinPipe with In", ErrOptions, func() error {
+			_, e := New(bufOptions(strings.NewReader(""), nil, nil)).StdinPipe()
+			return e
+		}},
+		{"StdinPipe with InString", ErrOptions, func() error {
+			_, e := New(func() *Options { return &Options{InString: "payload"} }).StdinPipe()
+			return e
+		}},
+		{"StdinPipe with InBytes", ErrOptions, func() error {
+			_, e := New(func() *Options { return &Options{InBytes: []byte{}} }).StdinPipe()
+			return e
+		}},
+		{"StdinPipe with NoStdin", ErrOptions, func() error {
+			_, e := New(func() *Options { return &Options{NoStdin: true} }).StdinPipe()
+			return e
+		}},
+	} {
+		err := tc.err()
+		assert.True(t, errors.Is(err, tc.want), "%s: %v", tc.name, err)
+	}
+}
+
+func TestErrorContext(t *testing.T) {
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	_, done := cmd.Start("sleep", "10")
+	pid := (<-cmd.Started()).Pid
+	err := cmd.Signal(syscall.Signal(999))
+	assert.True(t, errors.Is(err, syscall.EINVAL))
+	assert.Equal(t, fmt.Sprintf("signal 999 pid %d (sleep): %v", pid, syscall.EINVAL), err.Error())
+	assert.NoError(t, cmd.Kill())
+	<-done
+
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Usr = nil
+		o.Username = "cmdio-no-such-user"
+		return o
+	}
+	info := New(opts).Run("true")
+	var unknown user.UnknownUserError
+	assert.True(t, errors.As(info.Error, &unknown))
+	assert.Contains(t, info.Error.Error(), "credential of true: user cmdio-no-such-user")
+}
+
+func TestExitWriteFailure(t *testing.T) {
+	info := New(bufOptions(nil, failingWriter{}, nil)).Run("echo", "lost")
+	assert.Equal(t, errWrite, info.Error)
+	assert.Equal(t, -1, info.Exit)
+	assert.False(t, info.Signaled)
+	assert.Equal(t, ReasonExited, info.Reason)
+}
+
+func TestCoreDump(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("core dumps land in the working directory on linux only")
+	}
+	var lim syscall.Rlimit
+	assert.NoError(t, syscall.Getrlimit(syscall.RLIMIT_CORE, &lim))
+	if lim.Max == 0 {
+		t.Skip("core dumps are disabled")
+	}
+	pattern, _ := os.ReadFile("/proc/sys/kernel/core_pattern")
+	if strings.HasPrefix(string(pattern), "|") {
+		t.Skip("core dumps are piped to a helper")
+	}
+
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Dir = t.TempDir()
+		o.Rlimits = map[int]Rlimit{syscall.RLIMIT_CORE: {Cur: lim.Max, Max: lim.Max}}
+		return o
+	}
+	// the limits are applied right after the start, give them the time
+	info := New(opts).Run("sh", "-c", "sleep 0.2; kill -SEGV $$")
+	assert.Equal(t, syscall.SIGSEGV, info.Signal)
+	assert.True(t, info.Wait.CoreDump)
+	assert.Contains(t, info.String(), " core_dump=true")
+
+	info = New(bufOptions(nil, io.Discard, nil)).Run("sh", "-c", "kill -TERM $$")
+	assert.Equal(t, WaitDetails{}, info.Wait)
+}
+
+func TestUsername(t *testing.T) {
+	cur, err := user.Current()
+	assert.NoError(t, err)
+	opts := func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.Usr = nil
+		o.Username = cur.Username
+		return o
+	}
+	info := New(opts).Run(Testdata + "program.sh")
+	assertStart(t, info)
+	assert.Equal(t, cur.Uid, strconv.Itoa(info.Uid))
+	assert.Equal(t, cur.Gid, strconv.Itoa(info.Gid))
+	assert.Equal(t, cur.Username, info.Username)
+
+	opts = func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.Usr = nil
+		o.Username = "cmdio-no-such-user"
+		return o
+	}
+	_, err = New(opts).StartE(Testdata + "program.sh")
+	assert.Contains(t, err.Error(), "user cmdio-no-such-user")
+	info = New(opts).Run(Testdata + "program.sh")
+	assert.Error(t, info.Error)
+
+	opts = func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.Username = cur.Username
+		return o
+	}
+	_, err = New(opts).StartE(Testdata + "program.sh")
+	assert.True(t, errors.Is(err, ErrOptions))
+}
+
+func TestStart(t *testing.T) {
+	info := start("program.sh", stdOptions)
+	assertStart(t, info)
+}
+
+func TestWait(t *testing.T) {
+	cmd := New(stdOptions)
+	info := cmd.Wait()
+	assert.Equal(t, ErrNotStarted, info.Error)
+
+	cmd.Start(Testdata + "program.sh")
+	infos := make(chan *Info, 3)
+	for i := 0; i < cap(infos); i++ {
+		go func() { infos <- cmd.Wait() }()
+	}
+	for i := 0; i < cap(infos); i++ {
+		assertStart(t, <-infos)
+	}
+}
+
+func TestWaitListeners(t *testing.T) {
+	cmd := New(stdOptions)
+	cmd.Start(Testdata+"flaky.sh", filepath.Join(t.TempDir(), "count"), "2")
+
+	infos := make(chan *Info, 5)
+	for i := 0; i < cap(infos); i++ {
+		go func() { infos <- cmd.Wait() }()
+	}
+	for i := 0; i < cap(infos); i++ {
+		assert.Equal(t, 6, (<-infos).Exit)
+	}
+}
+
+func TestJoinInfo(t *testing.T) {
+	cmd := New(stdOptions)
+	first, second := cmd.JoinInfo(), cmd.JoinInfo()
+	cmd.Start(Testdata + "program.sh")
+
+	info := <-first
+	assertStart(t, &info)
+	assert.Equal(t, info, <-second)
+	_, ok := <-first
+	assert.False(t, ok, "channel should be closed")
+}
+
+func TestStarted(t *testing.T) {
+	cmd := New(stdOptions)
+	cmd.Start(Testdata + "program.sh")
+	res := <-cmd.Started()
+	assert.NoError(t, res.Err)
+	assert.Greater(t, res.Pid, 0)
+	assert.False(t, res.StartedAt.IsZero())
+	assert.Equal(t, res.Pid, cmd.Wait().Pid)
+
+	cmd = New(stdOptions)
+	cmd.Start(Testdata + "missing.sh")
+	res = <-cmd.Started()
+	assert.Error(t, res.Err)
+	assert.Equal(t, 0, res.Pid)
+}
+
+func TestContext(t *testing.T) {
+	cmd := New(stdOptions)
+	ctx := cmd.Context()
+	assert.NoError(t, ctx.Err())
+
+	cmd.Run(Testdata + "program.sh")
+	<-ctx.Done()
+	assert.Equal(t, context.Canceled, ctx.Err())
+	assert.Equal(t, context.Canceled, context.Cause(ctx))
+
+	cmd = New(stdOptions)
+	info := cmd.Run(Testdata+"flaky.sh", filepath.Join(t.TempDir(), "count"), "2")
+	<-cmd.Context().Done()
+	assert.Equal(t, info.Error, context.Cause(cmd.Context()))
+}
+
+func TestTerminate(t *testing.T) {
+	info, err := terminate("service.sh", stdOptions)
+	assert.NoError(t, err)
+	assertTerminate(t, info)
+}
+
+func TestSignal(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "usr1")
+	cmd := New(stdOptions)
+	assert.Equal(t, ErrNotStarted, cmd.Signal(syscall.SIGUSR1))
+
+	started, ctx := cmd.Start(Testdata+"signal.sh", marker)
+	<-started
+	time.Sleep(time.Second)
+
+	assert.NoError(t, cmd.Signal(syscall.SIGUSR1))
+	info := <-ctx
+	assertStart(t, &info)
+	assert.FileExists(t, marker)
+	assert.Equal(t, ErrAlreadyFinished, cmd.Signal(syscall.SIGUSR1))
+}
+
+func TestTerminateStates(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(*CmdIo)
+		err    error
+		signal bool
+	}{
+		{"created", func(*CmdIo) {}, ErrNotStarted, false},
+		{"running", func(c *CmdIo) {
+			started, _ := c.Start(Testdata + "service.sh")
+			<-started
+			time.Sleep(time.Second)
+		}, nil, true},
+		{"exited", func(c *CmdIo) { c.Run(Testdata + "program.sh") }, nil, false},
+		{"start failed", func(c *CmdIo) { c.Run(Testdata + "missing.sh") }, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := New(stdOptions)
+			test.setup(cmd)
+			err := cmd.Terminate()
+			assert.True(t, errors.Is(err, test.err), "unexpected error %v", err)
+			assert.Equal(t, test.signal, cmd.Info().Signaled)
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	before := goroutines()
+	cmd := New(stdOptions)
+	joined := cmd.JoinInfo()
+	started, complete := cmd.Start(Testdata + "service.sh")
+	<-started
+
+	assert.NoError(t, cmd.Close())
+	info := <-complete
+	assert.True(t, info.Killed, "info should be Killed")
+	<-joined
+
+	assert.Equal(t, ErrClosed, cmd.Close())
+	assert.Equal(t, ErrClosed, cmd.Terminate())
+	assert.Equal(t, ErrClosed, cmd.Kill())
+	assert.Equal(t, ErrClosed, cmd.Signal(syscall.SIGUSR1))
+	assertNoLeaks(t, before)
+}
+
+func TestCloseBeforeStart(t *testing.T) {
+	before := goroutines()
+	cmd := New(stdOptions)
+	joined := cmd.JoinInfo()
+
+	assert.NoError(t, cmd.Close())
+	<-joined
+	_, complete := cmd.Start(Testdata + "program.sh")
+	assert.Equal(t, ErrClosed, (<-complete).Error)
+	_, err := cmd.StartE(Testdata + "program.sh")
+	assert.Equal(t, ErrClosed, err)
+	assertNoLeaks(t, before)
+}
+
+func TestTerminateExited(t *testing.T) {
+	cmd := New(stdOptions)
+	info := cmd.Run(Testdata + "program.sh")
+
+	assert.NoError(t, cmd.Terminate())
+	assert.Equal(t, *info, cmd.Info())
+	assertStart(t, info)
+}
+
+func TestTerminateAndWait(t *testing.T) {
+	cmd := New(stdOptions)
+	started, _ := cmd.Start(Testdata + "service.sh")
+	<-started
+	time.Sleep(time.Second)
+
+	info, err := cmd.TerminateAndWait(time.Second)
+	assert.NoError(t, err)
+	assertTerminate(t, info)
+}
+
+func TestTerminateAndWaitExited(t *testing.T) {
+	cmd := New(stdOptions)
+	cmd.Run(Testdata + "program.sh")
+
+	info, err := cmd.TerminateAndWait(time.Second)
+	assert.NoError(t, err)
+	assertStart(t, info)
+}
+
+func TestTerminateAndWaitTimeout(t *testing.T) {
+	cmd := New(stdOptions)
+	started, ctx := cmd.Start(Testdata + "stubborn.sh")
+	<-started
+	time.Sleep(time.Second)
+
+	_, err := cmd.TerminateAndWait(500 * time.Millisecond)
+	assert.Equal(t, ErrWaitTimeout, err)
+	assert.NoError(t, cmd.Kill())
+	<-ctx
+}
+
+func TestTerminateGracefully(t *testing.T) {
+	cmd := New(stdOptions)
+	started, ctx := cmd.Start(Testdata + "service.sh")
+	<-started
+	time.Sleep(time.Second)
+
+	assert.NoError(t, cmd.TerminateGracefully(time.Second))
+	info := <-ctx
+	assertTerminate(t, &info)
+}
+
+func TestTerminateGracefullyEscalates(t *testing.T) {
+	cmd := New(stdOptions)
+	started, ctx := cmd.Start(Testdata + "stubborn.sh")
+	<-started
+	time.Sleep(time.Second)
+
+	assert.Equal(t, ErrKilled, cmd.TerminateGracefully(time.Second))
+	info := <-ctx
+	assert.True(t, info.Signaled, "info should be Signaled")
+	assert.Equal(t, syscall.SIGKILL, info.Signal)
+}
+
+func TestKill(t *testing.T) {
+	cmd := New(stdOptions)
+	started, ctx := cmd.Start(Testdata + "stubborn.sh")
+	<-started
+	time.Sleep(time.Second)
+
+	assert.NoError(t, cmd.Terminate())
+	assert.NoError(t, cmd.Kill())
+	info := <-ctx
+	assert.True(t, info.Signaled, "info should be Signaled")
+	assert.True(t, info.Killed, "info should be Killed")
+	assert.Equal(t, syscall.SIGKILL, info.Signal)
+	assert.NoError(t, cmd.Kill())
+}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	info := New(stdOptions).RunContext(ctx, Testdata+"service.sh")
+	assert.True(t, errors.Is(info.Error, context.DeadlineExceeded))
+	assert.True(t, info.Signaled, "info should be Signaled")
+	assert.Equal(t, 15, info.Exit, "should exit with 15")
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started, complete := New(stdOptions).StartContext(ctx, Testdata+"program.sh")
+	assert.False(t, <-started, "command should not start")
+	info := <-complete
+	assert.True(t, errors.Is(info.Error, context.Canceled))
+	assert.Equal(t, 0, info.Pid)
+}
+
+func TestTimeout(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.Timeout = time.Second
+		return o
+	}
+	info := New(opts).Run(Testdata+"sleep.sh", "5")
+	assert.True(t, errors.Is(info.Error, ErrTimeout))
+	assert.True(t, info.TimedOut, "info should be TimedOut")
+	assert.True(t, info.Signaled, "info should be Signaled")
+}
+
+func TestTimeoutNotExceeded(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.Timeout = 1500 * time.Millisecond
+		return o
+	}
+	info := New(opts).Run(Testdata+"sleep.sh", "1")
+	assertStart(t, info)
+	assert.False(t, info.TimedOut, "info should not be TimedOut")
+}
+
+func TestDeadline(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.Timeout = 5 * time.Second
+		o.Deadline = time.Now().Add(time.Second)
+		return o
+	}
+	info := New(opts).Run(Testdata+"sleep.sh", "5")
+	assert.True(t, errors.Is(info.Error, ErrDeadline))
+	assert.True(t, info.TimedOut, "info should be TimedOut")
+}
+
+func TestDeadlinePassed(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.Deadline = time.Now().Add(-time.Second)
+		return o
+	}
+	started, complete := New(opts).Start(Testdata + "program.sh")
+	assert.False(t, <-started, "command should not start")
+	info := <-complete
+	assert.True(t, errors.Is(info.Error, ErrDeadline))
+	assert.True(t, info.TimedOut, "info should be TimedOut")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.IdleTimeout = time.Second
+		return o
+	}
+	info := New(opts).Run(Testdata+"sleep.sh", "5")
+	assert.True(t, errors.Is(info.Error, ErrIdleTimeout))
+	assert.True(t, info.TimedOut, "info should be TimedOut")
+}
+
+func TestIdleTimeoutActive(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.IdleTimeout = time.Second
+		return o
+	}
+	info := New(opts).Run(Testdata+"ticker.sh", "10")
+	assertStart(t, info)
+	assert.False(t, info.TimedOut, "info should not be TimedOut")
+}
+
+func TestRunWithRetry(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "count")
+	policy := RetryPolicy{
+		MaxAttempts: 5,
+		Backoff:     ExponentialBackoff,
+		Delay:       50 * time.Millisecond,
+		Jitter:      0.5,
+	}
+	info := New(stdOptions).RunWithRetry(policy, Testdata+"flaky.sh", counter, "3")
+	assertStart(t, info)
+	assert.Equal(t, 3, info.Attempts)
+}
+
+func TestRunWithRetryPredicate(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "count")
+	policy := RetryPolicy{
+		MaxAttempts: 5,
+		Retry:       func(info Info) bool { return info.Exit == 7 },
+	}
+	info := New(stdOptions).RunWithRetry(policy, Testdata+"flaky.sh", counter, "3")
+	assert.Error(t, info.Error)
+	assert.Equal(t, 6, info.Exit)
+	assert.Equal(t, 1, info.Attempts)
+}
+
+func TestRunWithRetryTerminate(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "count")
+	policy := RetryPolicy{MaxAttempts: 5, Delay: time.Minute}
+	cmd := New(stdOptions)
+	go func() {
+		time.Sleep(time.Second)
+		_ = cmd.Terminate()
+	}()
+
+	now := time.Now()
+	info := cmd.RunWithRetry(policy, Testdata+"flaky.sh", counter, "3")
+	assert.Less(t, int64(time.Since(now)), int64(5*time.Second))
+	assert.Error(t, info.Error)
+	assert.Equal(t, 1, info.Attempts)
+}
+
+func TestKeepAlive(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.KeepAlive = &KeepAlive{MaxRestarts: 2, Delay: 50 * time.Millisecond}
+		return o
+	}
+	cmd := New(opts)
+	info := cmd.Run(Testdata + "program.sh")
+	assertStart(t, info)
+	assert.Equal(t, 3, info.Attempts)
+
+	generation := 0
+	for info := range cmd.Restarts() {
+		generation++
+		assert.Equal(t, generation, info.Attempts)
+	}
+	assert.Equal(t, 3, generation)
+}
+
+func TestKeepAliveCrashLoop(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.KeepAlive = &KeepAlive{CrashLoop: 3, CrashWindow: time.Minute}
+		return o
+	}
+	info := New(opts).Run(Testdata + "program.sh")
+	assert.Equal(t, ErrCrashLoop, info.Error)
+	assert.Equal(t, 3, info.Attempts)
+}
+
+func TestKeepAliveTerminate(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.KeepAlive = &KeepAlive{}
+		return o
+	}
+	info, err := terminate("service.sh", opts)
+	assert.NoError(t, err)
+	assertTerminate(t, info)
+	assert.Equal(t, 1, info.Attempts)
+}
+
+func TestWaitDelay(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.WaitDelay = 500 * time.Millisecond
+		return o
+	}
+
+	now := time.Now()
+	info := New(opts).Run(Testdata + "orphan.sh")
+	defer syscall.Kill(-info.Pid, syscall.SIGKILL)
+	assert.Less(t, int64(time.Since(now)), int64(5*time.Second))
+	assert.True(t, errors.Is(info.Error, exec.ErrWaitDelay))
+	assert.Contains(t, out.String(), "orphan.sh")
+}
+
+func TestWaitDelayDefault(t *testing.T) {
+	out := &writeLog{}
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		// the orphan is left in the group of this process and outlives the
+		// termination while it holds stdout
+		o.ProcessGroup = Inherit
+		return o
+	}
+	cmd := New(opts)
+	_, done := cmd.Start("sh", "-c", "(sleep 30 & echo $!); sleep 30")
+	<-cmd.Started()
+	var orphan int
+	for i := 0; i < 100 && orphan == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		out.mu.Lock()
+		orphan, _ = strconv.Atoi(strings.TrimSpace(strings.Join(out.writes, "")))
+		out.mu.Unlock()
+	}
+	if assert.NotZero(t, orphan) {
+		defer syscall.Kill(orphan, syscall.SIGKILL)
+	}
+
+	now := time.Now()
+	assert.NoError(t, cmd.Terminate())
+	select {
+	case info := <-done:
+		assert.True(t, info.Finished)
+		assert.Less(t, int64(time.Since(now)), int64(defaultWaitDelay+time.Second))
+	case <-time.After(10 * time.Second):
+		t.Fatal("the orphan held up the completion")
+	}
+}
+
+func TestDetach(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.Detach = true
+		return o
+	}
+	cmd := New(opts)
+	info := cmd.Run(Testdata+"sleep.sh", "10")
+	assert.NoError(t, info.Error)
+	assert.False(t, info.Finished, "info should not be finished")
+	assert.Greater(t, info.Pid, 0)
+	assert.NoError(t, syscall.Kill(info.Pid, 0))
+
+	assert.NoError(t, cmd.Terminate())
+	var ws syscall.WaitStatus
+	_, err := syscall.Wait4(info.Pid, &ws, 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, syscall.SIGTERM, ws.Signal())
+}
+
+func TestAdopt(t *testing.T) {
+	if _, err := procStart(os.Getpid()); errors.Is(err, ErrUnsupported) {
+		t.Skip("adopt is not supported here")
+	}
+	child := exec.Command(Testdata+"sleep.sh", "2")
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	assert.NoError(t, child.Start())
+	go func() { _ = child.Wait() }()
+
+	cmd, err := Adopt(child.Process.Pid)
+	assert.NoError(t, err)
+	info := cmd.Info()
+	assert.Equal(t, child.Process.Pid, info.Pid)
+	assert.Equal(t, child.Process.Pid, info.Pgid)
+	assert.InDelta(t, time.Now().UnixNano(), info.StartT, float64(2*time.Second))
+
+	info = *cmd.Wait()
+	assert.True(t, info.Finished, "info should be finished")
+	assert.Equal(t, -1, info.Exit)
+}
+
+func TestAdoptTerminate(t *testing.T) {
+	if _, err := procStart(os.Getpid()); errors.Is(err, ErrUnsupported) {
+		t.Skip("adopt is not supported here")
+	}
+	child := exec.Command(Testdata + "service.sh")
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	assert.NoError(t, child.Start())
+	go func() { _ = child.Wait() }()
+	time.Sleep(time.Second)
+
+	cmd, err := Adopt(child.Process.Pid)
+	assert.NoError(t, err)
+	info, err := cmd.TerminateAndWait(5 * time.Second)
+	assert.NoError(t, err)
+	assert.True(t, info.Signaled, "info should be Signaled")
+}
+
+func TestAdoptMissing(t *testing.T) {
+	_, err := Adopt(1 << 22)
+	assert.True(t, errors.Is(err, syscall.ESRCH))
+}
+
+func TestNoTee(t *testing.T) {
+	out := bytes.NewBufferString("")
+	err := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, err)()
+		o.NoTee = true
+		return o
+	}
+
+	stdout, stderr := captureStdio(t, func() {
+		info := New(opts).Run(Testdata+"io.sh", "hello")
+		assert.NoError(t, info.Error)
+	})
+	assert.Equal(t, "hello\n", out.String())
+	assert.Equal(t, "hello\n", err.String())
+	assert.Empty(t, stdout)
+	assert.Empty(t, stderr)
+}
+
+func TestQuiet(t *testing.T) {
+	opts := func() *Options {
+		o := stdOptions()
+		o.Quiet = true
+		return o
+	}
+
+	var info *Info
+	stdout, stderr := captureStdio(t, func() {
+		info = New(opts).Run(Testdata+"io.sh", "hello")
+	})
+	assertStart(t, info)
+	assert.Greater(t, info.Pid, 0)
+	assert.NotZero(t, info.EndT)
+	assert.Empty(t, stdout)
+	assert.Empty(t, stderr)
+}
+
+func TestStdoutPipe(t *testing.T) {
+	cmd := New(bufOptions(nil, nil, nil))
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+	_, err = cmd.StdoutPipe()
+	assert.Error(t, err)
+	defer stdout.Close()
+
+	cmd.Start(Testdata+"ticker.sh", "5")
+	scanner := bufio.NewScanner(stdout)
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "tick 1", scanner.Text())
+	assert.Zero(t, cmd.Info().EndT, "command should still be running")
+
+	lines := 1
+	for scanner.Scan() {
+		lines++
+	}
+	assert.Equal(t, 5, lines)
+	assertStart(t, cmd.Wait())
+
+	_, err = cmd.StderrPipe()
+	assert.Equal(t, ErrStarted, err)
+}
+
+func TestStdinPipe(t *testing.T) {
+	out := bytes.NewBufferString("")
+	cmd := New(bufOptions(os.Stdin, out, nil))
+	stdin, err := cmd.StdinPipe()
+	assert.NoError(t, err)
+
+	cmd.Start("cat")
+	_, err = io.WriteString(stdin, "hello\n")
+	assert.NoError(t, err)
+	_, err = io.WriteString(stdin, "world\n")
+	assert.NoError(t, err)
+	assert.NoError(t, stdin.Close())
+
+	assertStart(t, cmd.Wait())
+	assert.Equal(t, "hello\nworld\n", out.String())
+}
+
+func TestInString(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.InString = "hello world\n"
+		return o
+	}
+	assertStart(t, New(opts).Run(Testdata+"io.sh", "-"))
+	assert.Equal(t, "hello world\n", out.String())
+}
+
+func TestInBytesEmpty(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.InBytes = []byte{}
+		return o
+	}
+	assertStart(t, New(opts).Run("cat"))
+	assert.Empty(t, out.String())
+}
+
+func TestNoStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.NoStdin = true
+		return o
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	info := New(opts).Run(Testdata + "read.sh")
+	os.Stdin = stdin
+
+	assertStart(t, info)
+	assert.Equal(t, "eof\n", out.String())
+}
+
+func TestInConflict(t *testing.T) {
+	opts := func() *Options {
+		o := bufOptions(strings.NewReader("in"), nil, nil)()
+		o.InString = "in string"
+		return o
+	}
+	_, err := New(opts).StartE("cat")
+	assert.True(t, errors.Is(err, ErrOptions))
+	info := New(opts).Run("cat")
+	assert.True(t, errors.Is(info.Error, ErrOptions))
+}
+
+func TestOutWriters(t *testing.T) {
+	out := bytes.NewBufferString("")
+	extra := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.OutWriters = []io.Writer{failingWriter{}, extra}
+		return o
+	}
+
+	info := New(opts).Run(Testdata+"io.sh", "hello")
+	assertStart(t, info)
+	assert.Equal(t, "hello\n", out.String())
+	assert.Equal(t, "hello\n", extra.String())
+	assert.True(t, errors.Is(info.WriteError, errWrite))
+}
+
+func TestPrefix(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Prefix = "[svc] "
+		o.NoTee = true
+		return o
+	}
+	assertStart(t, New(opts).Run(Testdata+"ticker.sh", "2"))
+	assert.Equal(t, "[svc] tick 1\n[svc] tick 2\n", out.String())
+}
+
+func TestDecoratedWriter(t *testing.T) {
+	out := bytes.NewBufferString("")
+	w := prefixed(out, "app", 32)
+	for _, chunk := range []string{"par", "tial\nnext ", "10%\r20%\r", "done\n"} {
+		_, err := io.WriteString(w, chunk)
+		assert.NoError(t, err)
+	}
+	pre := "\x1b[32mapp\x1b[0m"
+	assert.Equal(t, pre+"partial\n"+pre+"next 10%\r20%\rdone\n", out.String())
+}
+
+func TestTimestampLines(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.TimestampLines = true
+		o.TimestampLayout = "2006-01-02"
+		return o
+	}
+	var info *Info
+	stdout, _ := captureStdio(t, func() {
+		info = New(opts).Run(Testdata+"io.sh", "héllo-wörld")
+	})
+	assertStart(t, info)
+	day := time.Now().Format("2006-01-02")
+	assert.Equal(t, day+" héllo-wörld\n", out.String())
+	assert.Equal(t, "héllo-wörld\n", stdout)
+}
+
+func TestTailLines(t *testing.T) {
+	opts := func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.TailLines = 2
+		return o
+	}
+	info := New(opts).Run(Testdata+"ticker.sh", "4")
+	assertStart(t, info)
+	assert.Equal(t, []string{"tick 3", "tick 4"}, info.Tail)
+}
+
+func TestTailRingBytes(t *testing.T) {
+	tail := &tailRing{max: 10, cap: 8}
+	for _, line := range []string{"one", "two", "three", "0123456789"} {
+		tail.push(line)
+	}
+	assert.Equal(t, []string{"23456789"}, tail.lines())
+	tail.push("four")
+	assert.Equal(t, []string{"four"}, tail.lines())
+}
+
+func TestOutputBytes(t *testing.T) {
+	info := New(bufOptions(nil, io.Discard, io.Discard)).Run(Testdata+"io.sh", "hello")
+	assertStart(t, info)
+	assert.Equal(t, int64(6), info.StdoutBytes)
+	assert.Equal(t, int64(6), info.StderrBytes)
+
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	started, _ := cmd.Start(Testdata+"ticker.sh", "5")
+	<-started
+	time.Sleep(500 * time.Millisecond)
+	assert.Greater(t, cmd.Info().StdoutBytes, int64(0))
+	assert.Equal(t, int64(35), cmd.Wait().StdoutBytes)
+
+	// written to stdout directly, nothing is counted
+	info = New(bufOptions(nil, nil, nil)).Run(Testdata+"io.sh", "hello")
+	assert.Zero(t, info.StdoutBytes)
+}
+
+func TestStdioDirect(t *testing.T) {
+	if os.Getenv("CMDIO_DIRECT_HELPER") != "" {
+		// started by the test below with stdout on a file, as it would be on
+		// a terminal, the command gets it as is
+		New(bufOptions(nil, nil, nil)).Run("sh", "-c", "[ -p /dev/stdout ] && echo pipe || echo direct")
+		// a background child holding stdout does not hold up the run
+		New(bufOptions(nil, nil, nil)).Run("sh", "-c", "sleep 3 & echo started")
+		os.Exit(0)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	assert.NoError(t, err)
+	defer out.Close()
+	helper := exec.Command(os.Args[0], "-test.run=^TestStdioDirect$")
+	helper.Env = append(os.Environ(), "CMDIO_DIRECT_HELPER=1")
+	helper.Stdout = out
+	now := time.Now()
+	assert.NoError(t, helper.Run())
+	assert.Less(t, int64(time.Since(now)), int64(2*time.Second))
+
+	b, err := os.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "direct\nstarted\n", string(b))
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.MaxOutputBytes = 10
+		return o
+	}
+	info := New(opts).Run(Testdata+"ticker.sh", "3")
+	assertStart(t, info)
+	assert.True(t, info.OutputTruncated, "output should be truncated")
+	assert.Equal(t, "tick 1\ntic", out.String())
+}
+
+func TestMaxOutputBytesKill(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.MaxOutputBytes = 10
+		o.KillOnMaxOutput = true
+		o.Prefix = "> "
+		return o
+	}
+	info := New(opts).Run(Testdata+"ticker.sh", "10")
+	assert.True(t, errors.Is(info.Error, ErrOutputLimit))
+	assert.True(t, info.OutputTruncated, "output should be truncated")
+	assert.Equal(t, "> tick 1\n", out.String())
+}
+
+func TestOutFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.OutFile = &FileOutput{Path: path, MaxBytes: 9, MaxBackups: 2}
+		o.Prefix = "> "
+		o.NoTee = true
+		return o
+	}
+	info := New(opts).Run(Testdata+"ticker.sh", "4")
+	assertStart(t, info)
+	assert.NoError(t, info.WriteError)
+
+	for file, want := range map[string]string{
+		path:        "> tick 4\n",
+		path + ".1": "> tick 3\n",
+		path + ".2": "> tick 2\n",
+	} {
+		got, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(got))
+	}
+
+	opts = func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.OutFile = &FileOutput{Path: filepath.Join(path, "missing")}
+		return o
+	}
+	info = New(opts).Run(Testdata+"ticker.sh", "1")
+	assert.Error(t, info.Error)
+}
+
+func TestRedact(t *testing.T) {
+	out := bytes.NewBufferString("")
+	var lines []string
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Redact = []string{"hunter2"}
+		o.RedactPatterns = []*regexp.Regexp{regexp.MustCompile(`token=\w+`)}
+		o.OnStdoutLine = func(line string) { lines = append(lines, line) }
+		o.NoTee = true
+		return o
+	}
+	assertStart(t, New(opts).Run(Testdata+"secret.sh", "4093"))
+	want := strings.Repeat("x", 4093) + "**** ****\n"
+	assert.Equal(t, want, out.String())
+	assert.Equal(t, []string{strings.TrimSuffix(want, "\n")}, lines)
+}
+
+func TestRedactWriter(t *testing.T) {
+	out := bytes.NewBufferString("")
+	w := &redactWriter{w: out, strs: [][]byte{[]byte("secret")}, keep: 5}
+	for _, chunk := range []string{strings.Repeat("x", 4094), "se", "cr", "et done\nsecrets", "ecret"} {
+		_, err := io.WriteString(w, chunk)
+		assert.NoError(t, err)
+	}
+	w.flush()
+	assert.Equal(t, strings.Repeat("x", 4094)+"**** done\n********", out.String())
+}
+
+func TestGzip(t *testing.T) {
+	gz := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Gzip = &GzipOutput{W: gz}
+		return o
+	}
+	cmd := New(opts)
+	cmd.Start(Testdata+"ticker.sh", "100")
+	time.Sleep(500 * time.Millisecond)
+	info, err := cmd.TerminateAndWait(5 * time.Second)
+	assert.NoError(t, err)
+	assert.True(t, info.Signaled)
+	assert.True(t, info.GzipRawBytes > 0)
+	assert.Equal(t, int64(gz.Len()), info.GzipBytes)
+
+	zr, err := gzip.NewReader(gz)
+	assert.NoError(t, err)
+	raw, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, info.GzipRawBytes, int64(len(raw)))
+	assert.True(t, strings.HasPrefix(string(raw), "tick 1\n"))
+}
+
+func TestFileWriterRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	f, err := openFile(FileOutput{Path: path, MaxBytes: 4}, false)
+	assert.NoError(t, err)
+	_, err = io.WriteString(f, "abcdefghij")
+	assert.NoError(t, err)
+	assert.NoError(t, f.close())
+
+	got, _ := os.ReadFile(path)
+	assert.Equal(t, "ij", string(got))
+	_, err = os.Stat(path + ".1")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAsyncOutput(t *testing.T) {
+	out := &slowWriter{delay: 50 * time.Millisecond}
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.AsyncOutput = &AsyncOutput{Size: 1, Policy: DropNewest}
+		o.NoTee = true
+		return o
+	}
+	info := New(opts).Run(Testdata+"ticker.sh", "10")
+	assertStart(t, info)
+	assert.Equal(t, info.StdoutBytes, int64(out.Len())+info.DroppedBytes)
+
+	out = &slowWriter{delay: 10 * time.Millisecond}
+	opts = func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.AsyncOutput = &AsyncOutput{}
+		return o
+	}
+	info = New(opts).Run(Testdata+"ticker.sh", "3")
+	assertStart(t, info)
+	assert.Zero(t, info.DroppedBytes)
+	assert.Equal(t, "tick 1\ntick 2\ntick 3\n", out.String())
+}
+
+func TestStdoutPipeWithOut(t *testing.T) {
+	cmd := New(bufOptions(nil, bytes.NewBufferString(""), nil))
+	_, err := cmd.StdoutPipe()
+	assert.Error(t, err)
+	_, err = cmd.StderrPipe()
+	assert.NoError(t, err)
+}
+
+func TestLines(t *testing.T) {
+	cmd := New(bufOptions(nil, nil, nil))
+	lines, err := cmd.Lines()
+	assert.NoError(t, err)
+	errLines, err := cmd.ErrLines()
+	assert.NoError(t, err)
+
+	cmd.Start(Testdata+"io.sh", "hello")
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	assert.Equal(t, []string{"hello"}, got)
+	assert.Equal(t, "hello", <-errLines)
+	assertStart(t, cmd.Wait())
+
+	_, err = cmd.Lines()
+	assert.Equal(t, ErrStarted, err)
+}
+
+func TestLinesLong(t *testing.T) {
+	long := strings.Repeat("x", 100000)
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	lines, _ := cmd.Lines()
+	cmd.Start(Testdata+"io.sh", long)
+	assert.Equal(t, long, <-lines)
+	assertStart(t, cmd.Wait())
+}
+
+func TestOnLine(t *testing.T) {
+	var stdout, stderr []string
+	opts := func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.OnStdoutLine = func(line string) {
+			time.Sleep(100 * time.Millisecond)
+			stdout = append(stdout, line)
+		}
+		o.OnStderrLine = func(line string) { stderr = append(stderr, line) }
+		return o
+	}
+
+	info := New(opts).Run(Testdata+"ticker.sh", "3")
+	assertStart(t, info)
+	assert.Equal(t, []string{"tick 1", "tick 2", "tick 3"}, stdout)
+	assert.Empty(t, stderr)
+}
+
+func TestWaitForOutput(t *testing.T) {
+	cmd := New(func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.OutputHistory = true
+		return o
+	})
+	cmd.Start(Testdata+"ticker.sh", "3")
+	ctx := context.Background()
+	assert.NoError(t, cmd.WaitForOutput(ctx, regexp.MustCompile(`tick 2`)))
+	assert.NoError(t, cmd.WaitForOutput(ctx, regexp.MustCompile(`^tick 1$`)))
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, cmd.WaitForOutput(tctx, regexp.MustCompile(`tick 3`)))
+
+	err := cmd.WaitForOutput(ctx, regexp.MustCompile(`listening`))
+	var oe *OutputError
+	assert.True(t, errors.As(err, &oe))
+	assert.Equal(t, []string{"tick 1", "tick 2", "tick 3"}, oe.Tail)
+	assert.True(t, oe.Info.Finished)
+}
+
+func TestWaitForOutputHistory(t *testing.T) {
+	// called before Start the output is kept without OutputHistory
+	cmd := New(bufOptions(nil, io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, cmd.WaitForOutput(ctx, regexp.MustCompile(`tick 2`)))
+	_, done := cmd.Start(Testdata+"ticker.sh", "3")
+	<-done
+	assert.NoError(t, cmd.WaitForOutput(context.Background(), regexp.MustCompile(`tick 2`)))
+
+	cmd = New(bufOptions(nil, io.Discard, nil))
+	_, done = cmd.Start(Testdata+"ticker.sh", "1")
+	<-cmd.Started()
+	assert.True(t, errors.Is(cmd.WaitForOutput(context.Background(), regexp.MustCompile(`tick`)), ErrStarted))
+	<-done
+	assert.Nil(t, cmd.olg)
+}
+
+func TestReadiness(t *testing.T) {
+	var polls int32
+	opts := func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.ReadinessInterval = 10 * time.Millisecond
+		o.Readiness = ReadinessFunc(func(ctx context.Context, info *Info) error {
+			if atomic.AddInt32(&polls, 1) < 3 || info.Pid == 0 {
+				return errors.New("not yet")
+			}
+			return nil
+		})
+		return o
+	}
+	cmd := New(opts)
+	cmd.Start(Testdata+"sleep.sh", "5")
+	assert.NoError(t, <-cmd.Ready())
+	assert.True(t, atomic.LoadInt32(&polls) >= 3)
+	assert.NoError(t, cmd.Terminate())
+	cmd.Wait()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	assert.NoError(t, ln.Close())
+	opts = func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.Readiness = DialCheck{Addr: addr}
+		return o
+	}
+	cmd = New(opts)
+	cmd.Start(Testdata+"sleep.sh", "5")
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, cmd.Terminate())
+	assert.Equal(t, context.Canceled, <-cmd.Ready())
+	cmd.Wait()
+
+	cmd = New(opts)
+	cmd.Start(Testdata+"ticker.sh", "1")
+	assert.Equal(t, ErrNotReady, <-cmd.Ready())
+	cmd.Wait()
+
+	cmd = New(bufOptions(nil, io.Discard, nil))
+	cmd.Start(Testdata+"ticker.sh", "1")
+	assert.NoError(t, <-cmd.Ready())
+	cmd.Wait()
+}
+
+func TestRaw(t *testing.T) {
+	data := make([]byte, 1<<20)
+	f, err := os.Open("/dev/urandom")
+	assert.NoError(t, err)
+	_, err = io.ReadFull(f, data)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	path := filepath.Join(t.TempDir(), "data")
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+
+	out := bytes.NewBufferString("")
+	var lines int32
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Raw = true
+		o.Prefix = "> "
+		o.TimestampLines = true
+		o.Redact = []string{"\n"}
+		o.OnStdoutLine = func(string) { atomic.AddInt32(&lines, 1) }
+		return o
+	}
+	stdout, _ := captureStdio(t, func() {
+		info := New(opts).Run(Testdata+"binary.sh", path)
+		assertStart(t, info)
+		assert.Equal(t, int64(len(data)), info.StdoutBytes)
+	})
+	assert.Equal(t, sha256.Sum256(data), sha256.Sum256(out.Bytes()))
+	assert.Zero(t, atomic.LoadInt32(&lines))
+	assert.Empty(t, stdout)
+}
+
+func TestDir(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Dir = dir
+		return o
+	}
+	assertStart(t, New(opts).Run(Testdata+"pwd.sh"))
+	assert.Equal(t, dir+"\n", out.String())
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, os.Chdir(wd)) }()
+	assert.NoError(t, os.Chdir(dir))
+	t.Setenv("PWD", "/")
+	out.Reset()
+	assertStart(t, New(bufOptions(nil, out, nil)).Run(Testdata+"pwd.sh"))
+	assert.Equal(t, dir+"\n", out.String())
+
+	opts = func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Dir = filepath.Join(dir, "missing")
+		return o
+	}
+	_, err = New(opts).StartE(Testdata + "pwd.sh")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Contains(t, err.Error(), "working directory")
+	info := New(opts).Run(Testdata + "pwd.sh")
+	assert.True(t, errors.Is(info.Error, os.ErrNotExist))
+}
+
+func TestEnvironment(t *testing.T) {
+	t.Setenv("CMDIO_BASE", "base")
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.EnvAppend = []string{"CMDIO_A=1", "CMDIO_B=2", "CMDIO_A=3"}
+		o.EnvMap = map[string]string{"CMDIO_B": "4", "CMDIO_C": "5"}
+		return o
+	}
+	cmd := New(opts)
+	env, err := cmd.Environ()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CMDIO_A=3", "CMDIO_B=4", "CMDIO_C=5"}, env[len(env)-3:])
+	assertStart(t, cmd.Run("env"))
+	for _, kv := range []string{"CMDIO_BASE=base", "CMDIO_A=3", "CMDIO_B=4", "CMDIO_C=5", "PATH="} {
+		assert.Contains(t, out.String(), kv)
+	}
+
+	opts = func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.Env = []string{"A=1", "B=2", "A=3"}
+		o.EnvMap = map[string]string{"C": "4"}
+		return o
+	}
+	env, err = New(opts).Environ()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"A=3", "B=2", "C=4"}, env)
+}
+
+func TestEnvAllowlist(t *testing.T) {
+	t.Setenv("CMDIO_KEEP", "keep")
+	t.Setenv("CMDIO_DROP", "drop")
+	t.Setenv("CMDIO_OVERRIDE", "old")
+	opts := func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.EnvAllowlist = []string{"CMDIO_KEEP", "CMDIO_OVERRIDE", "CMDIO_MISSING"}
+		o.Env = []string{"CMDIO_OVERRIDE=new", "CMDIO_EXTRA=1"}
+		return o
+	}
+	env, err := New(opts).Environ()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"CMDIO_KEEP=keep", "CMDIO_OVERRIDE=new", "CMDIO_EXTRA=1"}, env)
+
+	opts = func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.EnvAllowlist = []string{}
+		return o
+	}
+	env, err = New(opts).Environ()
+	assert.NoError(t, err)
+	assert.Empty(t, env)
+}
+
+func TestEnvFile(t *testing.T) {
+	t.Setenv("CMDIO_HOME", "/home/cmdio")
+	path := filepath.Join(t.TempDir(), ".env")
+	assert.NoError(t, os.WriteFile(path, []byte(`# settings
+PLAIN=value # comment
+export EXPORTED=yes
+SINGLE='${CMDIO_HOME} # kept'
+DOUBLE="line\none \"quoted\""
+DIR=${CMDIO_HOME}/data
+NESTED="$DIR/sub"
+`), 0644))
+
+	vars, err := EnvFromFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"PLAIN=value",
+		"EXPORTED=yes",
+		"SINGLE=${CMDIO_HOME} # kept",
+		"DOUBLE=line\none \"quoted\"",
+		"DIR=/home/cmdio/data",
+		"NESTED=/home/cmdio/data/sub",
+	}, vars)
+
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.EnvFile = path
+		o.EnvMap = map[string]string{"PLAIN": "override"}
+		return o
+	}
+	assertStart(t, New(opts).Run("env"))
+	assert.Contains(t, out.String(), "NESTED=/home/cmdio/data/sub\n")
+	assert.Contains(t, out.String(), "PLAIN=override\n")
+
+	assert.NoError(t, os.WriteFile(path, []byte("A=1\n\nB \"2\"\n"), 0644))
+	_, err = New(opts).StartE("env")
+	assert.True(t, errors.Is(err, ErrEnvSyntax))
+	assert.Contains(t, err.Error(), path+":3:")
+	info := New(opts).Run("env")
+	assert.True(t, errors.Is(info.Error, ErrEnvSyntax))
+
+	assert.NoError(t, os.WriteFile(path, []byte("A='open\n"), 0644))
+	_, err = EnvFromFile(path)
+	assert.True(t, errors.Is(err, ErrEnvSyntax))
+}
+
+func TestSplitFunc(t *testing.T) {
+	scanNUL := func(data []byte, eof bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if eof && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+	var got []string
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, out, nil)()
+		o.SplitFunc = scanNUL
+		o.Prefix = "> "
+		o.NoTee = true
+		o.OnStdoutLine = func(line string) { got = append(got, line) }
+		return o
+	}
+	assertStart(t, New(opts).Run("printf", "a\\0b c\\0d"))
+	assert.Equal(t, []string{"a", "b c", "d"}, got)
+	assert.Equal(t, "> a\x00> b c\x00> d", out.String())
+
+	got = nil
+	opts = func() *Options {
+		o := bufOptions(nil, io.Discard, nil)()
+		o.MaxLineBytes = 4
+		o.OnStdoutLine = func(line string) { got = append(got, line) }
+		return o
+	}
+	assertStart(t, New(opts).Run("printf", "abcdefghij"))
+	assert.Equal(t, []string{"abcd", "efgh", "ij"}, got)
+}
+
+func TestTranscript(t *testing.T) {
+	transcript := &MemoryTranscript{}
+	opts := func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.Transcript = transcript
+		return o
+	}
+
+	info := New(opts).Run(Testdata+"io.sh", "hello")
+	assertStart(t, info)
+	entries := transcript.Entries()
+	assert.Len(t, entries, 2)
+	streams := map[Stream]string{}
+	for i, e := range entries {
+		streams[e.Stream] = string(e.Data)
+		if i > 0 {
+			assert.False(t, e.Time.Before(entries[i-1].Time))
+		}
+	}
+	assert.Equal(t, map[Stream]string{Stdout: "hello\n", Stderr: "hello\n"}, streams)
+}
+
+func TestJSONTranscript(t *testing.T) {
+	out := bytes.NewBufferString("")
+	opts := func() *Options {
+		o := bufOptions(nil, nil, nil)()
+		o.Transcript = JSONTranscript(out)
+		return o
+	}
+
+	assertStart(t, New(opts).Run(Testdata+"io.sh", "hello"))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, out.String(), `"stream":"stdout","data":"hello\n"}`)
+	assert.Contains(t, out.String(), `"stream":"stderr","data":"hello\n"}`)
+}
+
+func TestOutput(t *testing.T) {
+	var out []byte
+	var info *Info
+	stdout, _ := captureStdio(t, func() {
+		out, info = New(bufOptions(nil, nil, nil)).Output(Testdata+"io.sh", "hello")
+	})
+	assertStart(t, info)
+	assert.Equal(t, "hello\n", string(out))
+	assert.Empty(t, stdout)
+}
+
+func TestOutputFailed(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "count")
+	out, info := New(bufOptions(nil, nil, nil)).Output(Testdata+"flaky.sh", counter, "2")
+	assert.Error(t, info.Error)
+	assert.Equal(t, 6, info.Exit)
+	assert.Equal(t, "flaky.sh attempt 1 of 2\n", string(out))
+}
+
+func TestStartBufIO(t *testing.T) {
+	expected := "hello world\n"
+	in := stringReader{
+		step: 0,
+		data: []string{expected},
+	}
+	out := bytes.NewBufferString("")
+	err := bytes.NewBufferString("")
+	cmd := New(bufOptions(in, out, err))
+	info := cmd.Run(Testdata+"io.sh", "-")
+	assert.NoError(t, info.Error)
+	assert.Equal(t, expected, out.String())
+	assert.Equal(t, expected, err.String())
+}
+
+// captureStdio runs fn with the stdout and stderr of the test process
+// redirected to files and returns what was written to them
+func captureStdio(t *testing.T, fn func()) (string, string) {
+	dir := t.TempDir()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	assert.NoError(t, err)
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	assert.NoError(t, err)
+
+	origOut, origErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	fn()
+	os.Stdout, os.Stderr = origOut, origErr
+
+	_ = stdout.Close()
+	_ = stderr.Close()
+	o, _ := os.ReadFile(stdout.Name())
+	e, _ := os.ReadFile(stderr.Name())
+	return string(o), string(e)
+}
+
+// exited waits up to 2s for pid to exit, a zombie has exited
+func exited(pid int) bool {
+	for i := 0; i < 100; i++ {
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			return true
+		}
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err == nil && strings.Contains(string(stat), ") Z ") {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+// goroutines counts the goroutines once the signal handler, which runs as
+// long as the process, has started
+func goroutines() int {
+	handler.Do(startSignalHandler)
+	time.Sleep(10 * time.Millisecond)
+	return runtime.NumGoroutine()
+}
+
+func assertNoLeaks(t *testing.T, before int) {
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines leaked")
+}
+
+func assertTerminate(t *testing.T, info *Info) {
+	assert.Error(t, info.Error)
+	assert.True(t, info.Finished, "info should be finished")
+	assert.Equal(t, Terminated, info.State)
+	assert.True(t, info.Signaled, "info should be Signaled")
+	if info.Signal == 0 {
+		// service.sh traps SIGTERM and exits with 15
+		assert.Equal(t, 15, info.Exit, "should exit with 15")
+		return
+	}
+	assert.Equal(t, syscall.SIGTERM, info.Signal, "should be terminated by SIGTERM")
+	assert.Equal(t, -1, info.Exit, "should exit with -1")
 }
 
 func assertStart(t *testing.T, info *Info) {
@@ -20,119 +20,188 @@ limitations under the License.
 package cmdio
 
 import (
-	"bytes"
 	"encoding/binary"
-	"os"
-	"os/signal"
+	"fmt"
+	"os/exec"
+	"runtime"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
-// Copyright (c) 2014 Mitchell Hashimoto
 const (
-	ctrlKern        = 1
-	kernProc        = 14
-	kernProcAll     = 0
-	kinfoStructSize = 648
+	procInfoCallListPids = 1
+	procPPidOnly         = 6
 )
 
-type kinfoProc struct {
-	_    [40]byte
-	Pid  int32
-	_    [199]byte
-	Comm [16]byte
-	_    [301]byte
-	PPid int32
-	_    [84]byte
-}
+// maxRSSUnit is the unit of ru_maxrss, bytes on darwin
+const maxRSSUnit = 1
 
-func darwinSyscall() (*bytes.Buffer, error) {
-	mib := [4]int32{ctrlKern, kernProc, kernProcAll, 0}
-	size := uintptr(0)
+// children lists the pids whose parent is ppid with proc_listpids, which
+// returns pids and nothing that depends on the layout of kinfo_proc
+func children(ppid int) ([]int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_PROC_INFO,
+			procInfoCallListPids, procPPidOnly, uintptr(ppid), 0, 0, 0)
+		if errno != 0 {
+			return nil, fmt.Errorf("proc_listpids ppid %d: %w", ppid, errno)
+		}
 
-	_, _, errno := syscall.Syscall6(
-		syscall.SYS___SYSCTL,
-		uintptr(unsafe.Pointer(&mib[0])),
-		4,
-		0,
-		uintptr(unsafe.Pointer(&size)),
-		0,
-		0)
+		// room for children started in the meantime
+		buf := make([]int32, n/4+16)
+		size := uintptr(len(buf) * 4)
+		n, _, errno = unix.Syscall6(unix.SYS_PROC_INFO,
+			procInfoCallListPids, procPPidOnly, uintptr(ppid), 0,
+			uintptr(unsafe.Pointer(&buf[0])), size)
+		if errno != 0 {
+			return nil, fmt.Errorf("proc_listpids ppid %d: %w", ppid, errno)
+		}
+		if n >= size {
+			// the buffer filled up, there may be more
+			continue
+		}
 
-	if errno != 0 {
-		return nil, errno
+		var pids []int
+		for _, pid := range buf[:n/4] {
+			if pid > 0 {
+				pids = append(pids, int(pid))
+			}
+		}
+		return pids, nil
 	}
+}
 
-	bs := make([]byte, size)
-	_, _, errno = syscall.Syscall6(
-		syscall.SYS___SYSCTL,
-		uintptr(unsafe.Pointer(&mib[0])),
-		4,
-		uintptr(unsafe.Pointer(&bs[0])),
-		uintptr(unsafe.Pointer(&size)),
-		0,
-		0)
-
-	if errno != 0 {
-		return nil, errno
+func procStart(pid int) (time.Time, error) {
+	proc, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("sysctl kern.proc.pid %d: %w", pid, err)
 	}
-
-	return bytes.NewBuffer(bs[0:size]), nil
+	start := proc.Proc.P_starttime
+	return time.Unix(start.Sec, int64(start.Usec)*int64(time.Microsecond)), nil
 }
 
-func children(ppid int) ([]int, error) {
-	buf, err := darwinSyscall()
-	if err != nil {
-		return nil, err
+func syscallAttrs(cred *credential, opt *Options) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Credential: cred,
+		Setsid:     opt.ProcessGroup == Session,
+		Setpgid:    opt.ProcessGroup == NewGroup,
+		Chroot:     opt.Chroot,
 	}
+}
 
-	procs := make([]*kinfoProc, 0, 50)
-	k := 0
-	for i := kinfoStructSize; i < buf.Len(); i += kinfoStructSize {
-		proc := &kinfoProc{}
-		err = binary.Read(bytes.NewBuffer(buf.Bytes()[k:i]), binary.LittleEndian, proc)
-		if err != nil {
-			return nil, err
-		}
+const (
+	procInfoCallPidInfo = 2
+	procPidTaskInfo     = 4
+	procTaskInfoSize    = 96
+)
 
-		k = i
-		procs = append(procs, proc)
+// procCPU returns the user and system time of pid from its proc_taskinfo
+func procCPU(pid int) (time.Duration, error) {
+	buf := make([]byte, procTaskInfoSize)
+	n, _, errno := unix.Syscall6(
+		unix.SYS_PROC_INFO,
+		procInfoCallPidInfo,
+		uintptr(pid),
+		procPidTaskInfo,
+		0,
+		uintptr(unsafe.Pointer(&buf[0])),
+		procTaskInfoSize)
+	if errno != 0 {
+		return 0, fmt.Errorf("proc_pidinfo pid %d: %w", pid, errno)
+	}
+	if n < procTaskInfoSize {
+		return 0, syscall.ESRCH
 	}
 
-	var pids []int
-	for _, p := range procs {
-		if ppid == int(p.PPid) {
-			pids = append(pids, int(p.Pid))
-		}
+	// pti_total_user and pti_total_system are in mach time units
+	t := binary.LittleEndian.Uint64(buf[16:]) + binary.LittleEndian.Uint64(buf[24:])
+	if runtime.GOARCH == "arm64" {
+		t = t * 125 / 3
 	}
-	return pids, nil
+	return time.Duration(t), nil
 }
 
-// end Copyright (c) 2014 Mitchell Hashimoto
+// startLimited - rlimits can only be set on this process here, where they
+// would limit all of it, Options.Rlimits is linux only
+func startLimited(cmd *exec.Cmd, limits map[int]Rlimit) error {
+	return ErrUnsupported
+}
 
-func syscallAttrs(cred *syscall.Credential) *syscall.SysProcAttr {
-	return &syscall.SysProcAttr{
-		Credential: cred,
-		Setsid:     true,
+// supported rejects the options that are not supported on darwin
+func supported(opt *Options) error {
+	if len(opt.CPUSet) > 0 {
+		return fmt.Errorf("CPUSet: %w", ErrUnsupported)
+	}
+	if opt.OOMScoreAdj != nil {
+		return fmt.Errorf("OOMScoreAdj: %w", ErrUnsupported)
+	}
+	if opt.Unshare != (Unshare{}) {
+		return fmt.Errorf("Unshare: %w", ErrUnsupported)
+	}
+	if opt.CgroupPath != "" {
+		return fmt.Errorf("CgroupPath: %w", ErrUnsupported)
+	}
+	if len(opt.AmbientCaps) > 0 {
+		return fmt.Errorf("AmbientCaps: %w", ErrUnsupported)
+	}
+	if len(opt.DropCaps) > 0 {
+		return fmt.Errorf("DropCaps: %w", ErrUnsupported)
+	}
+	if opt.NoNewPrivs {
+		return fmt.Errorf("NoNewPrivs: %w", ErrUnsupported)
+	}
+	if len(opt.Rlimits) > 0 {
+		return fmt.Errorf("Rlimits: %w", ErrUnsupported)
 	}
+	return nil
 }
 
-// TODO: Pass ALL signals to child pids
-func signalHandler() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c)
-	signal.Reset(syscall.SIGURG)
-	select {
-	case s := <-c:
-		forward(s.(syscall.Signal))
-	}
+func confine(opt *Options) error {
+	return nil
+}
+
+// waitIO - the storage io of a command is reported on linux only
+func waitIO(pid int) (read, write int64) {
+	return 0, 0
+}
+
+func setAffinity(pid int, cpus []int) error {
+	return ErrUnsupported
+}
+
+func setOOMScoreAdj(pid, adj int) error {
+	return ErrUnsupported
+}
+
+// cgroup is linux only
+type cgroup struct {
+	dir string
 }
 
-func forward(s syscall.Signal) {
-	ch, e := children(os.Getpid())
+func newCgroup(opt *Options) (*cgroup, error) {
+	return nil, ErrUnsupported
+}
+
+func (cg *cgroup) attrs(attrs *syscall.SysProcAttr) {}
+func (cg *cgroup) closeFD()                         {}
+func (cg *cgroup) signal(sig syscall.Signal)        {}
+func (cg *cgroup) kill()                            {}
+func (cg *cgroup) remove() error                    { return nil }
+
+// killChildren signals the process group of each child of ppid, or the
+// child itself when it is not a group leader
+func killChildren(ppid int, s syscall.Signal) {
+	ch, e := children(ppid)
 	if e == nil {
 		for _, pid := range ch {
-			_ = syscall.Kill(-pid, s)
+			if _, ok := detached.Load(pid); ok {
+				continue
+			}
+			if kill(-pid, s) == syscall.ESRCH {
+				_ = kill(pid, s)
+			}
 		}
 	}
 }
@@ -0,0 +1,209 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ErrEnvSyntax - a line of an env file is malformed
+var ErrEnvSyntax = errors.New("invalid env file syntax")
+
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// Environ - returns the environment a command is started with: Options.Env,
+// or the environment of this process when it is empty, overridden by
+// Options.EnvFile, Options.EnvAppend and then Options.EnvMap. With
+// Options.EnvAllowlist the allowed variables of this process are overridden
+// by Options.Env instead. A key set more than once keeps the position of its
+// first occurrence and the value of its last
+func (c *CmdIo) Environ() ([]string, error) {
+	var env []string
+	switch {
+	case c.opt.EnvAllowlist != nil:
+		env = append(allowed(os.Environ(), c.opt.EnvAllowlist), c.env...)
+	case len(c.env) > 0:
+		env = append(env, c.env...)
+	default:
+		env = os.Environ()
+	}
+	if c.opt.EnvFile != "" {
+		vars, e := envFile(c.opt.EnvFile, env)
+		if e != nil {
+			return nil, e
+		}
+		env = append(env, vars...)
+	}
+	env = append(env, c.opt.EnvAppend...)
+
+	keys := make([]string, 0, len(c.opt.EnvMap))
+	for k := range c.opt.EnvMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+c.opt.EnvMap[k])
+	}
+	_, fds := c.extraFiles()
+	env = append(env, fds...)
+	return dedupEnv(env), nil
+}
+
+// EnvFromFile - parses a dotenv file of KEY=VALUE lines, an optional
+// export prefix, # comments and single or double quoted values. Unquoted
+// and double quoted values expand $VAR and ${VAR} against the environment
+// of this process and the preceding lines
+func EnvFromFile(path string) ([]string, error) {
+	return envFile(path, os.Environ())
+}
+
+func envFile(path string, env []string) ([]string, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	vars, e := parseEnv(f, env)
+	if e != nil {
+		return nil, fmt.Errorf("%s:%w", path, e)
+	}
+	return vars, nil
+}
+
+// parseEnv parses the lines of r, expanding values against env
+func parseEnv(r io.Reader, env []string) ([]string, error) {
+	resolved := make(map[string]string, len(env))
+	for _, kv := range env {
+		resolved[envKey(kv)] = strings.TrimPrefix(kv[len(envKey(kv)):], "=")
+	}
+	expand := func(v string) string {
+		return os.Expand(v, func(k string) string { return resolved[k] })
+	}
+
+	var vars []string
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%d: %w: missing =", n, ErrEnvSyntax)
+		}
+		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if !envKeyRe.MatchString(key) {
+			return nil, fmt.Errorf("%d: %w: invalid key %q", n, ErrEnvSyntax, key)
+		}
+
+		switch {
+		case strings.HasPrefix(val, "'"):
+			j := strings.IndexByte(val[1:], '\'')
+			if j < 0 {
+				return nil, fmt.Errorf("%d: %w: unterminated quote", n, ErrEnvSyntax)
+			}
+			val = val[1 : j+1]
+		case strings.HasPrefix(val, `"`):
+			v, ok := unquote(val[1:])
+			if !ok {
+				return nil, fmt.Errorf("%d: %w: unterminated quote", n, ErrEnvSyntax)
+			}
+			val = expand(v)
+		default:
+			if j := strings.Index(val, " #"); j >= 0 {
+				val = strings.TrimSpace(val[:j])
+			}
+			val = expand(val)
+		}
+		resolved[key] = val
+		vars = append(vars, key+"="+val)
+	}
+	return vars, sc.Err()
+}
+
+// unquote returns the double quoted value s up to its closing quote
+func unquote(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), true
+		case '\\':
+			if i++; i == len(s) {
+				return "", false
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", false
+}
+
+// allowed returns the variables of env named in keys
+func allowed(env, keys []string) []string {
+	allow := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		allow[k] = true
+	}
+	var out []string
+	for _, kv := range env {
+		if allow[envKey(kv)] {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+func envKey(kv string) string {
+	if i := strings.IndexByte(kv, '='); i >= 0 {
+		return kv[:i]
+	}
+	return kv
+}
+
+// dedupEnv removes the duplicate keys of env, the last value wins
+func dedupEnv(env []string) []string {
+	idx := make(map[string]int, len(env))
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		k := envKey(kv)
+		if i, ok := idx[k]; ok {
+			out[i] = kv
+			continue
+		}
+		idx[k] = len(out)
+		out = append(out, kv)
+	}
+	return out
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// eventBuffer - the events a subscriber may fall behind by
+const eventBuffer = 64
+
+// Event - a change in the lifecycle of a command, see Subscribe
+type Event interface {
+	// Time - when the event happened
+	Time() time.Time
+}
+
+// StartedEvent - an attempt of the command started
+type StartedEvent struct {
+	At      time.Time
+	Pid     int
+	Attempt int
+}
+
+// SignaledEvent - a signal was sent to the command through Terminate,
+// Kill or Signal
+type SignaledEvent struct {
+	At     time.Time
+	Pid    int
+	Signal syscall.Signal
+}
+
+// ReadyEvent - the command became ready, see Ready
+type ReadyEvent struct {
+	At  time.Time
+	Pid int
+}
+
+// OutputTruncatedEvent - Options.MaxOutputBytes was reached
+type OutputTruncatedEvent struct {
+	At time.Time
+}
+
+// RestartScheduledEvent - an attempt completed and the next one starts
+// after Delay
+type RestartScheduledEvent struct {
+	At      time.Time
+	Attempt int
+	Delay   time.Duration
+	// Info - the attempt that completed
+	Info Info
+}
+
+// ExitedEvent - the command completed, it is the last event
+type ExitedEvent struct {
+	At   time.Time
+	Info Info
+}
+
+func (e StartedEvent) Time() time.Time          { return e.At }
+func (e SignaledEvent) Time() time.Time         { return e.At }
+func (e ReadyEvent) Time() time.Time            { return e.At }
+func (e OutputTruncatedEvent) Time() time.Time  { return e.At }
+func (e RestartScheduledEvent) Time() time.Time { return e.At }
+func (e ExitedEvent) Time() time.Time           { return e.At }
+
+// eventHub fans the events of a command out to its subscribers and
+// Options.EventLog
+type eventHub struct {
+	mu   sync.Mutex
+	subs []chan Event
+	last *ExitedEvent
+	log  *lineCallback
+	name string
+	seq  int64
+}
+
+// newEventHub writes the records to log on a goroutine of its own, events
+// are published with the lock of the command held and a slow or reentrant
+// log must not stall it
+func newEventHub(log io.Writer) *eventHub {
+	h := &eventHub{}
+	if log != nil {
+		h.log = newLineCallback(func(line string) {
+			// the log is best effort, it does not fail the command
+			_, _ = io.WriteString(log, line)
+		})
+	}
+	return h
+}
+
+// eventRecord - a line of Options.EventLog
+type eventRecord struct {
+	Seq     int64  `json:"seq"`
+	Time    string `json:"time"`
+	Event   string `json:"event"`
+	Name    string `json:"name"`
+	Pid     int    `json:"pid,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	Signal  int    `json:"signal,omitempty"`
+	DelayNs int64  `json:"delay_ns,omitempty"`
+	Exit    *int   `json:"exit,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Subscribe - returns a channel that delivers the lifecycle events of a
+// command and is closed after the ExitedEvent, each call gets its own
+// channel. Up to 64 events are buffered, further events are dropped
+// until the subscriber catches up, the ExitedEvent replaces the oldest
+// buffered event when the buffer is full
+func (c *CmdIo) Subscribe() <-chan Event {
+	h := c.evh
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, eventBuffer)
+	if h.last != nil {
+		ch <- *h.last
+		close(ch)
+		return ch
+	}
+	h.subs = append(h.subs, ch)
+	return ch
+}
+
+// named sets the command name of the records
+func (h *eventHub) named(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.name = name
+}
+
+// write queues e for the event log as a single line written at once, so
+// commands sharing a log do not interleave, the caller holds mu
+func (h *eventHub) write(e Event) {
+	if h.log == nil {
+		return
+	}
+	h.seq++
+	r := eventRecord{Seq: h.seq, Time: e.Time().UTC().Format(time.RFC3339Nano), Name: h.name}
+	switch e := e.(type) {
+	case StartedEvent:
+		r.Event, r.Pid, r.Attempt = "start", e.Pid, e.Attempt
+	case ReadyEvent:
+		r.Event, r.Pid = "ready", e.Pid
+	case SignaledEvent:
+		r.Event, r.Pid, r.Signal = "signal", e.Pid, int(e.Signal)
+	case OutputTruncatedEvent:
+		r.Event = "output_truncated"
+	case RestartScheduledEvent:
+		r.Event, r.Attempt, r.DelayNs = "restart", e.Attempt, int64(e.Delay)
+	case ExitedEvent:
+		exit := e.Info.Exit
+		r.Event, r.Pid, r.Exit = "exit", e.Info.Pid, &exit
+		r.Signal, r.Reason, r.Error = int(e.Info.Signal), e.Info.Reason.String(), errString(e.Info.Error)
+	}
+	b, _ := json.Marshal(r)
+	h.log.push(string(b) + "\n")
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.write(e)
+	for _, ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// exited delivers the last event, closes the subscriptions and waits for
+// the log to be written
+func (h *eventHub) exited(e ExitedEvent) {
+	h.mu.Lock()
+	h.write(e)
+	for _, ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// only the hub sends, there is room once one is taken
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- e
+		}
+		close(ch)
+	}
+	h.subs = nil
+	h.last = &e
+	h.mu.Unlock()
+
+	if h.log != nil {
+		h.log.close()
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileOutput - writes the output of a command to the file Path, rotating
+// it when MaxBytes or MaxAge is set
+type FileOutput struct {
+	Path string
+	// Truncate - truncates an existing file instead of appending to it
+	Truncate bool
+	// Perm - the permissions of a new file, 0644 by default
+	Perm os.FileMode
+	// MaxBytes - rotates the file once it holds MaxBytes
+	MaxBytes int64
+	// MaxAge - rotates the file once it has been open for MaxAge
+	MaxAge time.Duration
+	// MaxBackups - the number of rotated files kept as Path.1 to
+	// Path.MaxBackups, the newest first, none when zero
+	MaxBackups int
+}
+
+// fileWriter writes to a FileOutput, rotating on line boundaries in line mode
+type fileWriter struct {
+	opt   FileOutput
+	lines bool
+	f     *os.File
+	n     int64
+	t     time.Time
+	eol   bool
+}
+
+func openFile(opt FileOutput, lines bool) (*fileWriter, error) {
+	if opt.Perm == 0 {
+		opt.Perm = 0644
+	}
+	f := &fileWriter{opt: opt, lines: lines, eol: true}
+	flag := os.O_APPEND
+	if opt.Truncate {
+		flag = os.O_TRUNC
+	}
+	if e := f.open(flag); e != nil {
+		return nil, e
+	}
+	return f, nil
+}
+
+func (f *fileWriter) open(flag int) error {
+	fd, e := os.OpenFile(f.opt.Path, os.O_WRONLY|os.O_CREATE|flag, f.opt.Perm)
+	if e != nil {
+		return e
+	}
+	st, e := fd.Stat()
+	if e != nil {
+		_ = fd.Close()
+		return e
+	}
+	f.f, f.n, f.t = fd, st.Size(), time.Now()
+	return nil
+}
+
+func (f *fileWriter) Write(p []byte) (int, error) {
+	for b := p; len(b) > 0; {
+		if f.due() && (!f.lines || f.eol) {
+			if e := f.rotate(); e != nil {
+				return len(p) - len(b), e
+			}
+		}
+		chunk := b
+		if f.lines {
+			if i := bytes.IndexByte(b, '\n'); i >= 0 {
+				chunk = b[:i+1]
+			}
+		} else if f.opt.MaxBytes > 0 && f.n < f.opt.MaxBytes && f.n+int64(len(b)) > f.opt.MaxBytes {
+			chunk = b[:f.opt.MaxBytes-f.n]
+		}
+		n, e := f.f.Write(chunk)
+		f.n += int64(n)
+		if e != nil {
+			return len(p) - len(b) + n, e
+		}
+		f.eol = chunk[len(chunk)-1] == '\n'
+		b = b[len(chunk):]
+	}
+	return len(p), nil
+}
+
+func (f *fileWriter) due() bool {
+	if f.n == 0 {
+		return false
+	}
+	return (f.opt.MaxBytes > 0 && f.n >= f.opt.MaxBytes) ||
+		(f.opt.MaxAge > 0 && time.Since(f.t) >= f.opt.MaxAge)
+}
+
+func (f *fileWriter) rotate() error {
+	if e := f.f.Close(); e != nil {
+		return e
+	}
+	if f.opt.MaxBackups > 0 {
+		for i := f.opt.MaxBackups - 1; i > 0; i-- {
+			_ = os.Rename(f.backup(i), f.backup(i+1))
+		}
+		if e := os.Rename(f.opt.Path, f.backup(1)); e != nil {
+			return e
+		}
+	}
+	return f.open(os.O_TRUNC)
+}
+
+func (f *fileWriter) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.opt.Path, i)
+}
+
+func (f *fileWriter) close() error {
+	e := f.f.Sync()
+	if ce := f.f.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// GzipOutput - compresses the combined output of a command with gzip into
+// W, or the file Path when W is nil
+type GzipOutput struct {
+	W    io.Writer
+	Path string
+	// Level - the gzip compression level, gzip.DefaultCompression by default
+	Level int
+	// Perm - the permissions of a new file, 0644 by default
+	Perm os.FileMode
+}
+
+// gzipWriter is shared by stdout and stderr
+type gzipWriter struct {
+	lok sync.Mutex
+	zw  *gzip.Writer
+	f   *os.File
+	raw int64
+	cmp int64
+}
+
+func openGzip(opt GzipOutput) (*gzipWriter, error) {
+	g := &gzipWriter{}
+	w := opt.W
+	if w == nil {
+		if opt.Perm == 0 {
+			opt.Perm = 0644
+		}
+		f, e := os.OpenFile(opt.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, opt.Perm)
+		if e != nil {
+			return nil, e
+		}
+		g.f, w = f, f
+	}
+	level := opt.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	zw, e := gzip.NewWriterLevel(&countingWriter{w: w, cnt: &g.cmp}, level)
+	if e != nil {
+		if g.f != nil {
+			_ = g.f.Close()
+		}
+		return nil, e
+	}
+	g.zw = zw
+	return g, nil
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	g.lok.Lock()
+	defer g.lok.Unlock()
+
+	n, e := g.zw.Write(p)
+	g.raw += int64(n)
+	return n, e
+}
+
+// close completes the gzip stream so it is valid however the command ended
+func (g *gzipWriter) close() error {
+	g.lok.Lock()
+	defer g.lok.Unlock()
+
+	e := g.zw.Close()
+	if g.f != nil {
+		e = errors.Join(e, g.f.Sync(), g.f.Close())
+	}
+	return e
+}
+
+// openFiles opens Options.OutFile and Options.ErrFile for the first attempt
+func (c *CmdIo) openFiles() error {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	var e error
+	if c.opt.OutFile != nil && c.ofw == nil {
+		if c.ofw, e = openFile(*c.opt.OutFile, c.lineMode()); e != nil {
+			return e
+		}
+	}
+	if c.opt.ErrFile != nil && c.efw == nil {
+		if c.efw, e = openFile(*c.opt.ErrFile, c.lineMode()); e != nil {
+			return e
+		}
+	}
+	if c.opt.Gzip != nil && c.gzw == nil {
+		if c.gzw, e = openGzip(*c.opt.Gzip); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// closeFiles syncs and closes the files, errors are reported in
+// Info.WriteError
+func (c *CmdIo) closeFiles() {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	for _, f := range []*fileWriter{c.ofw, c.efw} {
+		if f != nil {
+			c.inf.WriteError = errors.Join(c.inf.WriteError, f.close())
+		}
+	}
+	if c.gzw != nil {
+		c.inf.WriteError = errors.Join(c.inf.WriteError, c.gzw.close())
+		c.inf.GzipRawBytes = c.gzw.raw
+		c.inf.GzipBytes = atomic.LoadInt64(&c.gzw.cmp)
+	}
+	c.ofw, c.efw, c.gzw = nil, nil, nil
+}
+
+// files returns the additional writers ws with the files a stream is
+// written to
+func (c *CmdIo) files(ws []io.Writer, f *fileWriter) []io.Writer {
+	ws = append([]io.Writer{}, ws...)
+	if f != nil {
+		ws = append(ws, f)
+	}
+	if c.gzw != nil {
+		ws = append(ws, c.gzw)
+	}
+	return ws
+}
@@ -0,0 +1,55 @@
+//go:build freebsd
+// +build freebsd
+
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// kinfoPid is the offset of ki_pid in struct kinfo_proc, after two ints
+// and eight pointers, ki_ppid follows it
+const kinfoPid = 8 + 8*unsafe.Sizeof(uintptr(0))
+
+// children reads the kinfo_proc of every process, each starts with its
+// own size
+func children(ppid int) ([]int, error) {
+	buf, err := unix.SysctlRaw("kern.proc.proc")
+	if err != nil {
+		return nil, fmt.Errorf("sysctl kern.proc.proc: %w", err)
+	}
+
+	var pids []int
+	for len(buf) >= int(kinfoPid)+8 {
+		n := int(binary.LittleEndian.Uint32(buf))
+		if n <= int(kinfoPid)+8 || n > len(buf) {
+			break
+		}
+		pid := int(int32(binary.LittleEndian.Uint32(buf[kinfoPid:])))
+		if int(int32(binary.LittleEndian.Uint32(buf[kinfoPid+4:]))) == ppid {
+			pids = append(pids, pid)
+		}
+		buf = buf[n:]
+	}
+	return pids, nil
+}
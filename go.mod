@@ -1,8 +1,11 @@
 module github.com/streamz/cmdio
 
-go 1.17
+go 1.20
 
-require github.com/stretchr/testify v1.6.1
+require (
+	github.com/stretchr/testify v1.6.1
+	golang.org/x/sys v0.30.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
@@ -0,0 +1,259 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// infoJSON is the JSON form of Info
+type infoJSON struct {
+	Name            string   `json:"name"`
+	Args            []string `json:"args,omitempty"`
+	State           State    `json:"state"`
+	Reason          Reason   `json:"reason"`
+	Pid             int      `json:"pid"`
+	Pgid            int      `json:"pgid,omitempty"`
+	Exit            int      `json:"exit"`
+	Signal          int      `json:"signal"`
+	CoreDump        bool     `json:"core_dump,omitempty"`
+	StopSignal      int      `json:"stop_signal,omitempty"`
+	Continued       bool     `json:"continued,omitempty"`
+	TrapCause       int      `json:"trap_cause,omitempty"`
+	UserTimeNs      int64    `json:"user_time_ns,omitempty"`
+	SystemTimeNs    int64    `json:"system_time_ns,omitempty"`
+	MaxRSS          int64    `json:"max_rss_bytes,omitempty"`
+	IOReadBytes     int64    `json:"io_read_bytes,omitempty"`
+	IOWriteBytes    int64    `json:"io_write_bytes,omitempty"`
+	Error           string   `json:"error,omitempty"`
+	StartedAt       string   `json:"started_at,omitempty"`
+	EndedAt         string   `json:"ended_at,omitempty"`
+	RuntimeNs       int64    `json:"runtime_ns"`
+	Runtime         string   `json:"runtime"`
+	Finished        bool     `json:"finished"`
+	Signaled        bool     `json:"signaled"`
+	Killed          bool     `json:"killed"`
+	TimedOut        bool     `json:"timed_out"`
+	Attempts        int      `json:"attempts"`
+	Uid             int      `json:"uid"`
+	Gid             int      `json:"gid"`
+	Username        string   `json:"username,omitempty"`
+	ExtraFiles      int      `json:"extra_files,omitempty"`
+	Caps            []string `json:"caps,omitempty"`
+	Cgroup          string   `json:"cgroup,omitempty"`
+	WriteError      string   `json:"write_error,omitempty"`
+	Tail            []string `json:"tail,omitempty"`
+	StdoutBytes     int64    `json:"stdout_bytes"`
+	StderrBytes     int64    `json:"stderr_bytes"`
+	OutputTruncated bool     `json:"output_truncated,omitempty"`
+	DroppedBytes    int64    `json:"dropped_bytes,omitempty"`
+	GzipRawBytes    int64    `json:"gzip_raw_bytes,omitempty"`
+	GzipBytes       int64    `json:"gzip_bytes,omitempty"`
+}
+
+// StartFailed - the command never ran, Error is a *StartError unless the
+// CmdIo itself could not be started, e.g. ErrClosed or ErrReused
+func (i Info) StartFailed() bool {
+	return i.Reason == ReasonStartFailed
+}
+
+func errString(e error) string {
+	if e == nil {
+		return ""
+	}
+	return e.Error()
+}
+
+func stringErr(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
+
+func unixNano(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+}
+
+func parseNano(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, e := time.Parse(time.RFC3339Nano, s)
+	if e != nil {
+		return 0, e
+	}
+	return t.UnixNano(), nil
+}
+
+// MarshalJSON - encodes Info with snake_case keys, RFC 3339 times, the
+// run time in nanoseconds and as a string and the errors as their messages
+func (i Info) MarshalJSON() ([]byte, error) {
+	return json.Marshal(infoJSON{
+		Name:            i.Name,
+		Args:            i.Args,
+		State:           i.State,
+		Reason:          i.Reason,
+		Pid:             i.Pid,
+		Pgid:            i.Pgid,
+		Exit:            i.Exit,
+		Signal:          int(i.Signal),
+		CoreDump:        i.Wait.CoreDump,
+		StopSignal:      int(i.Wait.StopSignal),
+		Continued:       i.Wait.Continued,
+		TrapCause:       i.Wait.TrapCause,
+		UserTimeNs:      int64(i.UserTime),
+		SystemTimeNs:    int64(i.SystemTime),
+		MaxRSS:          i.MaxRSS,
+		IOReadBytes:     i.IOReadBytes,
+		IOWriteBytes:    i.IOWriteBytes,
+		Error:           errString(i.Error),
+		StartedAt:       unixNano(i.StartT),
+		EndedAt:         unixNano(i.EndT),
+		RuntimeNs:       int64(i.RunT),
+		Runtime:         i.RunT.String(),
+		Finished:        i.Finished,
+		Signaled:        i.Signaled,
+		Killed:          i.Killed,
+		TimedOut:        i.TimedOut,
+		Attempts:        i.Attempts,
+		Uid:             i.Uid,
+		Gid:             i.Gid,
+		Username:        i.Username,
+		ExtraFiles:      i.ExtraFiles,
+		Caps:            i.Caps,
+		Cgroup:          i.Cgroup,
+		WriteError:      errString(i.WriteError),
+		Tail:            i.Tail,
+		StdoutBytes:     i.StdoutBytes,
+		StderrBytes:     i.StderrBytes,
+		OutputTruncated: i.OutputTruncated,
+		DroppedBytes:    i.DroppedBytes,
+		GzipRawBytes:    i.GzipRawBytes,
+		GzipBytes:       i.GzipBytes,
+	})
+}
+
+// UnmarshalJSON - decodes the JSON of MarshalJSON, the errors are restored
+// with their messages only and no longer match the sentinels of cmdio
+func (i *Info) UnmarshalJSON(b []byte) error {
+	var j infoJSON
+	if e := json.Unmarshal(b, &j); e != nil {
+		return e
+	}
+	start, e := parseNano(j.StartedAt)
+	if e != nil {
+		return e
+	}
+	end, e := parseNano(j.EndedAt)
+	if e != nil {
+		return e
+	}
+
+	*i = Info{
+		Name:   j.Name,
+		Args:   j.Args,
+		State:  j.State,
+		Reason: j.Reason,
+		Pid:    j.Pid,
+		Pgid:   j.Pgid,
+		Exit:   j.Exit,
+		Signal: syscall.Signal(j.Signal),
+		Wait: WaitDetails{
+			CoreDump:   j.CoreDump,
+			StopSignal: syscall.Signal(j.StopSignal),
+			Continued:  j.Continued,
+			TrapCause:  j.TrapCause,
+		},
+		UserTime:        time.Duration(j.UserTimeNs),
+		SystemTime:      time.Duration(j.SystemTimeNs),
+		MaxRSS:          j.MaxRSS,
+		IOReadBytes:     j.IOReadBytes,
+		IOWriteBytes:    j.IOWriteBytes,
+		Error:           stringErr(j.Error),
+		StartT:          start,
+		EndT:            end,
+		RunT:            time.Duration(j.RuntimeNs),
+		Finished:        j.Finished,
+		Signaled:        j.Signaled,
+		Killed:          j.Killed,
+		TimedOut:        j.TimedOut,
+		Attempts:        j.Attempts,
+		Uid:             j.Uid,
+		Gid:             j.Gid,
+		Username:        j.Username,
+		ExtraFiles:      j.ExtraFiles,
+		Caps:            j.Caps,
+		Cgroup:          j.Cgroup,
+		WriteError:      stringErr(j.WriteError),
+		Tail:            j.Tail,
+		StdoutBytes:     j.StdoutBytes,
+		StderrBytes:     j.StderrBytes,
+		OutputTruncated: j.OutputTruncated,
+		DroppedBytes:    j.DroppedBytes,
+		GzipRawBytes:    j.GzipRawBytes,
+		GzipBytes:       j.GzipBytes,
+	}
+	return nil
+}
+
+// logValue quotes s when it would not read as a single value
+func logValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// String - renders Info as one line of key=value pairs, the pid, exit and
+// times are left out when the command did not start
+func (i Info) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "name=%s state=%s", logValue(i.Name), i.State)
+	if i.Reason != ReasonNone {
+		fmt.Fprintf(&b, " reason=%s", i.Reason)
+	}
+	if i.Pid > 0 {
+		fmt.Fprintf(&b, " pid=%d exit=%d signaled=%t", i.Pid, i.Exit, i.Signaled)
+		if i.Signal > 0 {
+			fmt.Fprintf(&b, " signal=%d", int(i.Signal))
+		}
+		if i.Wait.CoreDump {
+			b.WriteString(" core_dump=true")
+		}
+		if i.TimedOut {
+			b.WriteString(" timed_out=true")
+		}
+		fmt.Fprintf(&b, " runtime=%s", i.RunT)
+		if i.StartT > 0 {
+			fmt.Fprintf(&b, " started=%s", time.Unix(0, i.StartT).UTC().Format(time.RFC3339))
+		}
+	}
+	if i.Error != nil {
+		fmt.Fprintf(&b, " error=%s", logValue(i.Error.Error()))
+	}
+	return b.String()
+}
@@ -0,0 +1,388 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+)
+
+// lineBuffer is the capacity of the channels returned by Lines and ErrLines
+const lineBuffer = 64
+
+// lineWriter splits the output written to it into lines with split,
+// bufio.ScanLines by default, lines are buffered until they are complete
+// or reach max bytes when max is set
+type lineWriter struct {
+	buf   []byte
+	split bufio.SplitFunc
+	max   int
+	emit  func(string)
+	done  func()
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	l.scan(false)
+	for l.max > 0 && len(l.buf) >= l.max {
+		l.emit(string(l.buf[:l.max]))
+		l.buf = l.buf[l.max:]
+		l.scan(false)
+	}
+	return len(p), nil
+}
+
+func (l *lineWriter) scan(eof bool) {
+	split := l.split
+	if split == nil {
+		split = bufio.ScanLines
+	}
+	for len(l.buf) > 0 {
+		adv, tok, e := split(l.buf, eof)
+		if adv > len(l.buf) {
+			adv = len(l.buf)
+		}
+		if tok != nil {
+			l.emit(string(tok))
+		}
+		l.buf = l.buf[adv:]
+		if adv == 0 || e != nil {
+			return
+		}
+	}
+}
+
+// flush emits a trailing line without a delimiter and completes the writer
+func (l *lineWriter) flush() {
+	l.scan(true)
+	if len(l.buf) > 0 {
+		l.emit(string(l.buf))
+	}
+	l.buf = nil
+	if l.done != nil {
+		l.done()
+	}
+}
+
+// Lines - returns a channel that delivers the stdout of a command line by
+// line as it is produced, it must be called before Start and is closed once
+// the command completes. When the channel is full the command is blocked
+// unless Options.DropLines is set, in which case lines are dropped
+func (c *CmdIo) Lines() (<-chan string, error) {
+	return c.lines(&c.osp)
+}
+
+// ErrLines - returns a channel that delivers the stderr of a command line
+// by line, see Lines
+func (c *CmdIo) ErrLines() (<-chan string, error) {
+	return c.lines(&c.esp)
+}
+
+func (c *CmdIo) lines(sp *[]*lineWriter) (<-chan string, error) {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	if c.ran {
+		return nil, ErrStarted
+	}
+
+	ch := make(chan string, lineBuffer)
+	drop := c.opt.DropLines
+	*sp = append(*sp, c.lineWriter(
+		func(line string) {
+			if !drop {
+				ch <- line
+				return
+			}
+			select {
+			case ch <- line:
+			default:
+			}
+		},
+		func() { close(ch) },
+	))
+	return ch, nil
+}
+
+// lineWriter returns a lineWriter splitting with Options.SplitFunc
+func (c *CmdIo) lineWriter(emit func(string), done func()) *lineWriter {
+	return &lineWriter{split: c.opt.SplitFunc, max: c.opt.MaxLineBytes, emit: emit, done: done}
+}
+
+// lineCallback queues lines for a callback run on its own goroutine so a
+// slow callback never blocks the command
+type lineCallback struct {
+	fn  func(string)
+	lok sync.Mutex
+	cnd *sync.Cond
+	que []string
+	run bool
+	end bool
+	fin chan struct{}
+}
+
+func newLineCallback(fn func(string)) *lineCallback {
+	cb := &lineCallback{fn: fn, fin: make(chan struct{})}
+	cb.cnd = sync.NewCond(&cb.lok)
+	return cb
+}
+
+func (cb *lineCallback) push(line string) {
+	cb.lok.Lock()
+	defer cb.lok.Unlock()
+
+	cb.que = append(cb.que, line)
+	if !cb.run {
+		cb.run = true
+		go cb.loop()
+	}
+	cb.cnd.Signal()
+}
+
+func (cb *lineCallback) loop() {
+	defer close(cb.fin)
+	for {
+		cb.lok.Lock()
+		for len(cb.que) == 0 && !cb.end {
+			cb.cnd.Wait()
+		}
+		que, end := cb.que, cb.end
+		cb.que = nil
+		cb.lok.Unlock()
+
+		for _, line := range que {
+			cb.fn(line)
+		}
+		if end && len(que) == 0 {
+			return
+		}
+	}
+}
+
+// close waits until every queued line has been passed to the callback
+func (cb *lineCallback) close() {
+	cb.lok.Lock()
+	cb.end = true
+	run := cb.run
+	cb.cnd.Signal()
+	cb.lok.Unlock()
+
+	if run {
+		<-cb.fin
+	}
+}
+
+// defaultTailBytes bounds the memory of Options.TailLines when
+// Options.TailBytes is not set
+const defaultTailBytes = 64 << 10
+
+// tailRing keeps the most recent lines of output within a line and byte limit
+type tailRing struct {
+	lok sync.Mutex
+	max int
+	cap int
+	len int
+	lns []string
+}
+
+func (t *tailRing) push(line string) {
+	t.lok.Lock()
+	defer t.lok.Unlock()
+
+	if len(line) > t.cap {
+		line = line[len(line)-t.cap:]
+	}
+	t.lns = append(t.lns, line)
+	t.len += len(line)
+	for len(t.lns) > t.max || t.len > t.cap {
+		t.len -= len(t.lns[0])
+		t.lns = t.lns[1:]
+	}
+}
+
+func (t *tailRing) lines() []string {
+	t.lok.Lock()
+	defer t.lok.Unlock()
+
+	return append([]string(nil), t.lns...)
+}
+
+// outputHistory bounds the output produced before WaitForOutput is called
+// that it matches
+const outputHistory = 64 << 10
+
+// OutputError - returned by WaitForOutput when the command completes
+// before its output matched, it unwraps to the error of Info
+type OutputError struct {
+	Pattern string
+	Info    Info
+	// Tail - the last lines of output
+	Tail []string
+}
+
+func (e *OutputError) Error() string {
+	return fmt.Sprintf("command completed before its output matched %q", e.Pattern)
+}
+
+func (e *OutputError) Unwrap() error {
+	return e.Info.Error
+}
+
+// WaitForOutput - blocks until a line of stdout or stderr matches re,
+// including the lines produced before the call, returns an *OutputError
+// when the command completes first and the error of ctx when it is done
+func (c *CmdIo) WaitForOutput(ctx context.Context, re *regexp.Regexp) error {
+	c.lok.Lock()
+	if c.olg == nil {
+		if c.ran {
+			c.lok.Unlock()
+			return fmt.Errorf("WaitForOutput requires Options.OutputHistory once the command is started: %w", ErrStarted)
+		}
+		c.keepOutput()
+	}
+	olg := c.olg
+	c.lok.Unlock()
+
+	w := olg.wait(re)
+	defer olg.cancel(w)
+
+	select {
+	case <-w.hit:
+		return nil
+	case <-olg.end:
+		select {
+		case <-w.hit:
+			return nil
+		default:
+		}
+		return &OutputError{Pattern: re.String(), Info: c.final(), Tail: olg.tal.lines()}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type outputWaiter struct {
+	re  *regexp.Regexp
+	hit chan struct{}
+}
+
+// outputLog keeps the recent lines of stdout and stderr and wakes the
+// waiters matching them
+type outputLog struct {
+	lok  sync.Mutex
+	tal  tailRing
+	wts  []*outputWaiter
+	open int
+	end  chan struct{}
+}
+
+// keepOutput adds the output log to the line writers, its lines are capped
+// at the history since a longer one could not be kept
+func (c *CmdIo) keepOutput() {
+	c.olg = newOutputLog()
+	for _, sp := range []*[]*lineWriter{&c.osp, &c.esp} {
+		l := c.lineWriter(c.olg.push, c.olg.done)
+		if l.max <= 0 || l.max > outputHistory {
+			l.max = outputHistory
+		}
+		*sp = append(*sp, l)
+	}
+}
+
+func newOutputLog() *outputLog {
+	return &outputLog{tal: tailRing{max: outputHistory, cap: outputHistory}, open: 2, end: make(chan struct{})}
+}
+
+func (o *outputLog) push(line string) {
+	o.lok.Lock()
+	defer o.lok.Unlock()
+
+	o.tal.push(line)
+	wts := o.wts[:0]
+	for _, w := range o.wts {
+		if w.re.MatchString(line) {
+			close(w.hit)
+			continue
+		}
+		wts = append(wts, w)
+	}
+	o.wts = wts
+}
+
+func (o *outputLog) wait(re *regexp.Regexp) *outputWaiter {
+	o.lok.Lock()
+	defer o.lok.Unlock()
+
+	w := &outputWaiter{re: re, hit: make(chan struct{})}
+	for _, line := range o.tal.lines() {
+		if re.MatchString(line) {
+			close(w.hit)
+			return w
+		}
+	}
+	o.wts = append(o.wts, w)
+	return w
+}
+
+func (o *outputLog) cancel(w *outputWaiter) {
+	o.lok.Lock()
+	defer o.lok.Unlock()
+
+	for i, x := range o.wts {
+		if x == w {
+			o.wts = append(o.wts[:i], o.wts[i+1:]...)
+			return
+		}
+	}
+}
+
+// done completes the log once both streams are done
+func (o *outputLog) done() {
+	o.lok.Lock()
+	defer o.lok.Unlock()
+
+	if o.open--; o.open == 0 {
+		close(o.end)
+	}
+}
+
+// split adds the line writers to the output w
+func split(w io.Writer, sp []*lineWriter) io.Writer {
+	if len(sp) == 0 || w == nil {
+		return w
+	}
+	ws := []io.Writer{w}
+	for _, l := range sp {
+		ws = append(ws, l)
+	}
+	return io.MultiWriter(ws...)
+}
+
+func (c *CmdIo) flushLines() {
+	c.lok.Lock()
+	sp := append(append([]*lineWriter{}, c.osp...), c.esp...)
+	c.osp, c.esp = nil, nil
+	c.lok.Unlock()
+
+	for _, l := range sp {
+		l.flush()
+	}
+}
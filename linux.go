@@ -20,17 +20,290 @@ limitations under the License.
 package cmdio
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
-func syscallAttrs(cred *syscall.Credential) *syscall.SysProcAttr {
-	return &syscall.SysProcAttr{
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat
+const clockTicks = 100
+
+// maxRSSUnit is the unit of ru_maxrss, kilobytes
+const maxRSSUnit = 1024
+
+func syscallAttrs(cred *credential, opt *Options) *syscall.SysProcAttr {
+	attrs := &syscall.SysProcAttr{
 		Credential: cred,
-		Setsid:     true,
-		Pdeathsig:  syscall.SIGKILL,
+		Setsid:     opt.ProcessGroup == Session,
+		Setpgid:    opt.ProcessGroup == NewGroup,
+		Chroot:     opt.Chroot,
+		Pdeathsig:  opt.DeathSignal,
+	}
+	if opt.Unshare.PID {
+		attrs.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	if opt.Unshare.Mount {
+		attrs.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if opt.Unshare.Net {
+		attrs.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if opt.Unshare.UTS {
+		attrs.Cloneflags |= syscall.CLONE_NEWUTS
+	}
+	attrs.AmbientCaps, _, _ = capabilities(opt.AmbientCaps)
+	if attrs.Pdeathsig == 0 {
+		attrs.Pdeathsig = syscall.SIGTERM
 	}
+	if opt.Detach {
+		attrs.Pdeathsig = 0
+	}
+	return attrs
+}
+
+// startLimited starts cmd and applies limits with prlimit right after, the
+// command runs unconstrained until then and is killed when a limit fails
+func startLimited(cmd *exec.Cmd, limits map[int]Rlimit) error {
+	if e := cmd.Start(); e != nil {
+		return e
+	}
+	for res, lim := range limits {
+		lim := unix.Rlimit(lim)
+		if e := unix.Prlimit(cmd.Process.Pid, res, &lim, nil); e != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return fmt.Errorf("rlimit %d: %w", res, e)
+		}
+	}
+	return nil
+}
+
+// supported rejects the options that are not supported on linux
+func supported(opt *Options) error {
+	return nil
 }
 
-func signalHandler() {
-	// No-op
+// confine sets no_new_privs and drops the bounding capabilities of the
+// calling thread, which the command inherits when it forks from it. Both
+// are per thread and can not be undone, the goroutine stays locked to the
+// thread so that it is discarded when the goroutine exits
+func confine(opt *Options) error {
+	drop, _, e := capabilities(opt.DropCaps)
+	if e != nil {
+		return e
+	}
+	if !opt.NoNewPrivs && len(drop) == 0 {
+		return nil
+	}
+	runtime.LockOSThread()
+	for i, n := range drop {
+		e := unix.Prctl(unix.PR_CAPBSET_DROP, n, 0, 0, 0)
+		if e == unix.EPERM {
+			return fmt.Errorf("dropping %s requires CAP_SETPCAP: %w", opt.DropCaps[i], e)
+		}
+		if e != nil {
+			return fmt.Errorf("drop %s: %w", opt.DropCaps[i], e)
+		}
+	}
+	if opt.NoNewPrivs {
+		if e := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); e != nil {
+			return fmt.Errorf("no new privs: %w", e)
+		}
+	}
+	return nil
+}
+
+// cpuSetSize is CPU_SETSIZE, the cpus a unix.CPUSet holds
+const cpuSetSize = 1024
+
+// setAffinity pins pid to cpus
+func setAffinity(pid int, cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= cpuSetSize {
+			return fmt.Errorf("cpu %d: %w", cpu, syscall.EINVAL)
+		}
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(pid, &set)
+}
+
+// setOOMScoreAdj sets the oom_score_adj of pid
+func setOOMScoreAdj(pid, adj int) error {
+	return os.WriteFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid), []byte(strconv.Itoa(adj)), 0)
+}
+
+// children returns the pids whose parent is ppid, from
+// /proc/<ppid>/task/*/children where the kernel provides it and otherwise
+// from the stat of every process
+func children(ppid int) ([]int, error) {
+	if tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", ppid)); len(tasks) > 0 {
+		var pids []int
+		for _, task := range tasks {
+			b, err := os.ReadFile(task)
+			if err != nil {
+				continue
+			}
+			for _, f := range strings.Fields(string(b)) {
+				if pid, err := strconv.Atoi(f); err == nil {
+					pids = append(pids, pid)
+				}
+			}
+		}
+		return pids, nil
+	}
+
+	dir, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, d := range dir {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		// the process may have exited since /proc was read
+		fields, err := procStat(pid)
+		if err != nil {
+			continue
+		}
+		if fields[1] == strconv.Itoa(ppid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// killChildren signals the process group of each child of ppid, or the
+// child itself when it is not a group leader
+func killChildren(ppid int, s syscall.Signal) {
+	ch, e := children(ppid)
+	if e == nil {
+		for _, pid := range ch {
+			if _, ok := detached.Load(pid); ok {
+				continue
+			}
+			if kill(-pid, s) == syscall.ESRCH {
+				_ = kill(pid, s)
+			}
+		}
+	}
+}
+
+// procStat returns the fields of /proc/<pid>/stat from the state onwards,
+// fields[0] is field 3 of proc(5)
+func procStat(pid int) ([]string, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// comm may contain spaces, the remaining fields follow its closing paren
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return fields, nil
+}
+
+func procStart(pid int) (time.Time, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// waitIO waits for pid to exit without reaping it and returns the bytes
+// it and its waited children read from and wrote to storage, zero when
+// /proc/<pid>/io can not be read
+func waitIO(pid int) (read, write int64) {
+	var info unix.Siginfo
+	for {
+		e := unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if e == nil {
+			break
+		}
+		if e != unix.EINTR {
+			return 0, 0
+		}
+	}
+
+	b, e := os.ReadFile(fmt.Sprintf("/proc/%d/io", pid))
+	if e != nil {
+		// ptrace protected or accounting is not configured
+		return 0, 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		key, val, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseInt(val, 10, 64)
+		switch key {
+		case "read_bytes":
+			read = n
+		case "write_bytes":
+			write = n
+		}
+	}
+	return read, write
+}
+
+// procCPU returns the user and system time of pid and its waited children
+func procCPU(pid int) (time.Duration, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	var ticks int64
+	for _, f := range fields[11:15] {
+		t, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		ticks += t
+	}
+	return time.Duration(ticks) * time.Second / clockTicks, nil
+}
+
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v := strings.TrimPrefix(s.Text(), "btime "); v != s.Text() {
+			sec, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
 }
@@ -0,0 +1,99 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// StdoutPipe - returns a pipe connected to the stdout of a command, it
+// must be called before Start and can not be combined with Options.Out,
+// the write end is closed once the command completes
+func (c *CmdIo) StdoutPipe() (io.ReadCloser, error) {
+	return c.pipe(&c.opw, c.out, "StdoutPipe", "Out")
+}
+
+// StderrPipe - returns a pipe connected to the stderr of a command, it
+// must be called before Start and can not be combined with Options.Err,
+// the write end is closed once the command completes
+func (c *CmdIo) StderrPipe() (io.ReadCloser, error) {
+	return c.pipe(&c.epw, c.err, "StderrPipe", "Err")
+}
+
+// StdinPipe - returns a pipe connected to the stdin of a command, it must
+// be called before Start and takes the place of os.Stdin, it can not be
+// combined with the other stdin options. Closing it sends EOF to the command
+func (c *CmdIo) StdinPipe() (io.WriteCloser, error) {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	switch {
+	case c.ran:
+		return nil, ErrStarted
+	case c.ipr != nil:
+		return nil, fmt.Errorf("%w: StdinPipe already called", ErrOptions)
+	case c.in != nil && c.in != os.Stdin:
+		return nil, fmt.Errorf("%w: StdinPipe can not be combined with Options.In", ErrOptions)
+	case c.opt.InString != "":
+		return nil, fmt.Errorf("%w: StdinPipe can not be combined with Options.InString", ErrOptions)
+	case c.opt.InBytes != nil:
+		return nil, fmt.Errorf("%w: StdinPipe can not be combined with Options.InBytes", ErrOptions)
+	case c.opt.NoStdin:
+		return nil, fmt.Errorf("%w: StdinPipe can not be combined with Options.NoStdin", ErrOptions)
+	}
+
+	r, w, e := os.Pipe()
+	if e != nil {
+		return nil, e
+	}
+	c.ipr = r
+	return w, nil
+}
+
+func (c *CmdIo) pipe(pw **os.File, w io.Writer, name, opt string) (io.ReadCloser, error) {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	switch {
+	case c.ran:
+		return nil, ErrStarted
+	case *pw != nil:
+		return nil, fmt.Errorf("%w: %s already called", ErrOptions, name)
+	case w != nil:
+		return nil, fmt.Errorf("%w: %s can not be combined with Options.%s", ErrOptions, name, opt)
+	}
+
+	r, wr, e := os.Pipe()
+	if e != nil {
+		return nil, e
+	}
+	*pw = wr
+	return r, nil
+}
+
+func (c *CmdIo) closePipes() {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	for _, pw := range []*os.File{c.ipr, c.opw, c.epw} {
+		if pw != nil {
+			_ = pw.Close()
+		}
+	}
+}
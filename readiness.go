@@ -0,0 +1,117 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrNotReady - the command completed before its readiness check passed
+var ErrNotReady = errors.New("command completed before it was ready")
+
+// defaultReadinessInterval - the polling interval of Options.Readiness
+// when Options.ReadinessInterval is not set
+const defaultReadinessInterval = 100 * time.Millisecond
+
+// ReadinessCheck - reports whether a started command is ready, a nil error
+// means it is, see Options.Readiness
+type ReadinessCheck interface {
+	Ready(ctx context.Context, info *Info) error
+}
+
+// ReadinessFunc - adapts a function to a ReadinessCheck
+type ReadinessFunc func(ctx context.Context, info *Info) error
+
+// Ready - calls f
+func (f ReadinessFunc) Ready(ctx context.Context, info *Info) error {
+	return f(ctx, info)
+}
+
+// DialCheck - a ReadinessCheck that passes once Addr accepts connections
+type DialCheck struct {
+	// Network - tcp by default
+	Network string
+	Addr    string
+}
+
+// Ready - dials Addr
+func (d DialCheck) Ready(ctx context.Context, _ *Info) error {
+	network := d.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, e := (&net.Dialer{}).DialContext(ctx, network, d.Addr)
+	if e != nil {
+		return e
+	}
+	return conn.Close()
+}
+
+// Ready - returns a channel that delivers nil once the command is ready,
+// or an error when it fails to start, completes first or is terminated.
+// Without Options.Readiness a command is ready once it has started
+func (c *CmdIo) Ready() <-chan error {
+	return c.rdy
+}
+
+// ready delivers the readiness of the command once
+func (c *CmdIo) ready(e error) {
+	c.lok.Lock()
+	defer c.lok.Unlock()
+
+	if !c.rdd {
+		c.rdd = true
+		if e == nil {
+			c.evh.publish(ReadyEvent{At: time.Now(), Pid: c.inf.Pid})
+		}
+		c.rdy <- e
+	}
+}
+
+// poll runs Options.Readiness until it passes, the command completes or
+// it is terminated
+func (c *CmdIo) poll(ctx context.Context, cancel context.CancelFunc) {
+	defer cancel()
+
+	interval := c.opt.ReadinessInterval
+	if interval <= 0 {
+		interval = defaultReadinessInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		info := c.Info()
+		if c.opt.Readiness.Ready(ctx, &info) == nil {
+			c.ready(nil)
+			return
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			if c.ctx.Err() != nil {
+				c.ready(ErrNotReady)
+			} else {
+				c.ready(ctx.Err())
+			}
+			return
+		}
+	}
+}
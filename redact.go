@@ -0,0 +1,147 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// redacted is written in place of a secret
+var redacted = []byte("****")
+
+// defaultRedactWindow bounds the matches of Options.RedactPatterns across
+// writes when Options.RedactWindow is not set
+const defaultRedactWindow = 256
+
+// redactWriter replaces secrets before they reach w, the bytes a secret
+// split across writes could start with are held back until the next write
+// or flush. Secrets never span lines, so complete lines are never held
+type redactWriter struct {
+	w    io.Writer
+	strs [][]byte
+	res  []*regexp.Regexp
+	keep int
+	buf  []byte
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	if e := r.emit(false); e != nil {
+		return 0, e
+	}
+	return len(p), nil
+}
+
+func (r *redactWriter) flush() {
+	_ = r.emit(true)
+}
+
+// emit writes the buffer up to the point no incomplete secret can start
+func (r *redactWriter) emit(eof bool) error {
+	end := len(r.buf)
+	if !eof {
+		end -= r.keep
+		if nl := bytes.LastIndexByte(r.buf, '\n'); nl >= end {
+			end = nl + 1
+		}
+		if end <= 0 {
+			return nil
+		}
+	}
+
+	var out []byte
+	pos := 0
+	for _, m := range r.matches() {
+		if m[0] >= end {
+			break
+		}
+		if m[0] < pos {
+			if m[1] > pos {
+				pos = m[1]
+			}
+			continue
+		}
+		out = append(append(out, r.buf[pos:m[0]]...), redacted...)
+		pos = m[1]
+	}
+	if pos < end {
+		out = append(out, r.buf[pos:end]...)
+	} else {
+		end = pos
+	}
+	r.buf = append(r.buf[:0], r.buf[end:]...)
+	if len(out) == 0 {
+		return nil
+	}
+	_, e := r.w.Write(out)
+	return e
+}
+
+// matches returns the secrets in the buffer ordered by their start
+func (r *redactWriter) matches() [][]int {
+	var ms [][]int
+	for _, s := range r.strs {
+		for i := 0; ; {
+			j := bytes.Index(r.buf[i:], s)
+			if j < 0 {
+				break
+			}
+			ms = append(ms, []int{i + j, i + j + len(s)})
+			i += j + len(s)
+		}
+	}
+	for _, re := range r.res {
+		for _, m := range re.FindAllIndex(r.buf, -1) {
+			if m[1] > m[0] {
+				ms = append(ms, m)
+			}
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i][0] < ms[j][0] })
+	return ms
+}
+
+// redact wraps w with the filter of Options.Redact and RedactPatterns
+func (c *CmdIo) redact(w io.Writer) io.Writer {
+	if w == nil || len(c.opt.Redact)+len(c.opt.RedactPatterns) == 0 {
+		return w
+	}
+	r := &redactWriter{w: w, res: c.opt.RedactPatterns}
+	for _, s := range c.opt.Redact {
+		if s != "" {
+			r.strs = append(r.strs, []byte(s))
+			if len(s) > r.keep {
+				r.keep = len(s)
+			}
+		}
+	}
+	if len(r.res) > 0 {
+		window := c.opt.RedactWindow
+		if window <= 0 {
+			window = defaultRedactWindow
+		}
+		if window > r.keep {
+			r.keep = window
+		}
+	}
+	r.keep--
+	c.flushOnExit(r)
+	return r
+}
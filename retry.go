@@ -0,0 +1,152 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrCrashLoop - a KeepAlive command exited too often within the crash window
+var ErrCrashLoop = errors.New("command is crash looping")
+
+// errStop - stops relaunching without changing the final Info
+var errStop = errors.New("stop")
+
+// relauncher decides whether, and after what delay, a completed command is run again
+type relauncher interface {
+	next(attempt int, info Info) (time.Duration, error)
+}
+
+// Backoff - the strategy used to space out retry attempts
+type Backoff int
+
+const (
+	// FixedBackoff - waits Delay between every attempt
+	FixedBackoff Backoff = iota
+	// ExponentialBackoff - doubles Delay after every attempt up to MaxDelay
+	ExponentialBackoff
+)
+
+// RetryPolicy - controls how RunWithRetry re-runs a failed command
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     Backoff
+	Delay       time.Duration
+	MaxDelay    time.Duration
+	// Jitter - randomly shortens each delay by up to this fraction (0-1)
+	Jitter float64
+	// Retry - decides if an attempt should be retried, when nil any
+	// attempt that completed with an error is retried
+	Retry func(Info) bool
+}
+
+// KeepAlive - controls how a long running command is relaunched when it exits
+type KeepAlive struct {
+	// MaxRestarts - the number of relaunches, zero means unlimited
+	MaxRestarts int
+	Backoff     Backoff
+	Delay       time.Duration
+	MaxDelay    time.Duration
+	// Stable - resets the backoff once a generation has run this long
+	Stable time.Duration
+	// CrashLoop - stops relaunching with ErrCrashLoop after this many
+	// exits within CrashWindow
+	CrashLoop   int
+	CrashWindow time.Duration
+}
+
+type keepAlive struct {
+	opt KeepAlive
+	lvl int
+	ext []time.Time
+}
+
+func (k *keepAlive) next(attempt int, info Info) (time.Duration, error) {
+	if k.opt.MaxRestarts > 0 && attempt > k.opt.MaxRestarts {
+		return 0, errStop
+	}
+
+	// the attempt has just ended, unlike EndT this is not moved by
+	// adjustments of the wall clock
+	end := time.Now()
+	if k.opt.CrashLoop > 0 {
+		ext := k.ext[:0]
+		for _, t := range k.ext {
+			if end.Sub(t) < k.opt.CrashWindow {
+				ext = append(ext, t)
+			}
+		}
+		k.ext = append(ext, end)
+		if len(k.ext) >= k.opt.CrashLoop {
+			return 0, ErrCrashLoop
+		}
+	}
+
+	if k.opt.Stable > 0 && info.RunT >= k.opt.Stable {
+		k.lvl = 0
+	}
+	k.lvl++
+	p := RetryPolicy{Backoff: k.opt.Backoff, Delay: k.opt.Delay, MaxDelay: k.opt.MaxDelay}
+	return p.delay(k.lvl), nil
+}
+
+// RunWithRetry - synchronously runs a command, re-running it with a fresh
+// process according to policy, Terminate aborts any pending retry
+func (c *CmdIo) RunWithRetry(policy RetryPolicy, name string, args ...string) *Info {
+	c.lok.Lock()
+	if !c.ran {
+		c.rel = &policy
+	}
+	c.lok.Unlock()
+
+	return c.Run(name, args...)
+}
+
+func (p *RetryPolicy) next(attempt int, info Info) (time.Duration, error) {
+	if !p.retry(attempt, info) {
+		return 0, errStop
+	}
+	return p.delay(attempt), nil
+}
+
+func (p *RetryPolicy) retry(attempt int, info Info) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	if p.Retry == nil {
+		return info.Error != nil
+	}
+	return p.Retry(info)
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Delay
+	if p.Backoff == ExponentialBackoff {
+		for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+			d *= 2
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
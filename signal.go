@@ -0,0 +1,99 @@
+//go:build darwin || linux || freebsd || openbsd || netbsd || dragonfly
+// +build darwin linux freebsd openbsd netbsd dragonfly
+
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// forwarded are the signals passed to the commands, those that end this
+// process by default are raised again once they are forwarded
+var forwarded = map[syscall.Signal]bool{
+	syscall.SIGHUP:   true,
+	syscall.SIGINT:   true,
+	syscall.SIGQUIT:  true,
+	syscall.SIGTERM:  true,
+	syscall.SIGUSR1:  true,
+	syscall.SIGUSR2:  true,
+	syscall.SIGWINCH: false,
+	syscall.SIGCONT:  false,
+}
+
+var (
+	// notify receives each forwarded signal on its own channel so that it
+	// can be stopped on its own
+	notify = map[syscall.Signal]chan os.Signal{}
+	// signals passes the signals of every notify channel to signalHandler
+	signals = make(chan syscall.Signal, 1)
+	relays  sync.WaitGroup
+)
+
+// startSignalHandler installs the handler, it is called once for all the
+// commands this process manages
+func startSignalHandler() {
+	for s := range forwarded {
+		c := make(chan os.Signal, 1)
+		notify[s] = c
+		signal.Notify(c, s)
+		relays.Add(1)
+		go relay(c)
+	}
+	go signalHandler()
+}
+
+// stopSignalHandler restores the default handling of the signals and ends
+// signalHandler
+func stopSignalHandler() {
+	for _, c := range notify {
+		signal.Stop(c)
+		close(c)
+	}
+	relays.Wait()
+	close(signals)
+}
+
+func relay(c chan os.Signal) {
+	defer relays.Done()
+	for s := range c {
+		signals <- s.(syscall.Signal)
+	}
+}
+
+// signalHandler passes the signals this process receives to the commands
+// it manages
+func signalHandler() {
+	for s := range signals {
+		forward(s)
+		if forwarded[s] {
+			raise(s)
+		}
+	}
+}
+
+// raise stops handling s and sends it to this process again, which then
+// ends as it would without the handler. An application that handles s
+// itself receives it a second time
+func raise(s syscall.Signal) {
+	signal.Stop(notify[s])
+	_ = kill(os.Getpid(), s)
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// prints the working directory and whether /etc/passwd of the host is visible
+func main() {
+	wd, _ := os.Getwd()
+	_, err := os.Stat("/etc/passwd")
+	fmt.Println(wd, err == nil)
+}
@@ -0,0 +1,4 @@
+#!/bin/bash
+setsid sleep 30 > /dev/null 2>&1 < /dev/null &
+echo $!
+sleep 30
@@ -0,0 +1,4 @@
+#!/bin/bash
+cat <&3
+echo "metrics" >&$CMDIO_FD_metrics
+echo "fd $CMDIO_FD_metrics"
@@ -0,0 +1,7 @@
+#!/bin/bash
+count=$(( $(cat "$1" 2>/dev/null || echo 0) + 1 ))
+echo $count > "$1"
+echo "flaky.sh attempt $count of $2"
+if [ $count -lt $2 ] ; then
+exit 6
+fi
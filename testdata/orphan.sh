@@ -0,0 +1,3 @@
+#!/bin/bash
+echo "orphan.sh leaving a child holding stdout"
+sleep 10 &
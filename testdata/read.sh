@@ -0,0 +1,6 @@
+#!/bin/bash
+if read line ; then
+echo "read: $line"
+else
+echo "eof"
+fi
@@ -0,0 +1,4 @@
+#!/bin/bash
+sleep 0.2
+ulimit -n
+ulimit -Hn
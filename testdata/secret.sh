@@ -0,0 +1,5 @@
+#!/bin/bash
+head -c $1 /dev/zero | tr '\0' x
+printf "hun"
+sleep 0.2
+printf "ter2 token=abc123\n"
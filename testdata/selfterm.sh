@@ -0,0 +1,3 @@
+#!/bin/bash
+echo "selfterm.sh terminating itself"
+kill -TERM $$
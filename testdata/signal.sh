@@ -0,0 +1,5 @@
+#!/bin/bash
+echo "signal.sh running as child of PID $$"
+trap 'touch "$1"; exit 0' SIGUSR1
+sleep 10000 &
+wait
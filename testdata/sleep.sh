@@ -0,0 +1,3 @@
+#!/bin/bash
+echo "sleep.sh sleeping for $1 seconds"
+sleep $1
@@ -0,0 +1,6 @@
+#!/bin/bash
+echo "stubborn.sh running as child of PID $$"
+trap 'echo "stubborn.sh ignoring SIGTERM"' SIGTERM
+while : ; do
+sleep 1
+done
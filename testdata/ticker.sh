@@ -0,0 +1,5 @@
+#!/bin/bash
+for i in $(seq 1 $1) ; do
+echo "tick $i"
+sleep 0.2
+done
@@ -0,0 +1,119 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Stream - identifies an output stream of a command
+type Stream int
+
+const (
+	// Stdout - the standard output of a command
+	Stdout Stream = iota + 1
+	// Stderr - the standard error of a command
+	Stderr
+)
+
+func (s Stream) String() string {
+	switch s {
+	case Stdout:
+		return "stdout"
+	case Stderr:
+		return "stderr"
+	}
+	return "unknown"
+}
+
+// Entry - a chunk of output recorded in a transcript
+type Entry struct {
+	Time   time.Time
+	Stream Stream
+	Data   []byte
+}
+
+// Transcript - receives the output of both streams of a command in the
+// order it was observed, Record is never called concurrently
+type Transcript interface {
+	Record(Entry)
+}
+
+// MemoryTranscript - a Transcript that keeps every entry in memory
+type MemoryTranscript struct {
+	lok sync.Mutex
+	ent []Entry
+}
+
+// Record -
+func (m *MemoryTranscript) Record(e Entry) {
+	m.lok.Lock()
+	defer m.lok.Unlock()
+
+	m.ent = append(m.ent, e)
+}
+
+// Entries - returns the recorded entries
+func (m *MemoryTranscript) Entries() []Entry {
+	m.lok.Lock()
+	defer m.lok.Unlock()
+
+	return append([]Entry(nil), m.ent...)
+}
+
+// JSONTranscript - a Transcript that writes each entry to w as a line of JSON
+func JSONTranscript(w io.Writer) Transcript {
+	return &jsonTranscript{enc: json.NewEncoder(w)}
+}
+
+type jsonTranscript struct {
+	enc *json.Encoder
+}
+
+func (j *jsonTranscript) Record(e Entry) {
+	_ = j.enc.Encode(struct {
+		Time   time.Time `json:"time"`
+		Stream string    `json:"stream"`
+		Data   string    `json:"data"`
+	}{e.Time, e.Stream.String(), string(e.Data)})
+}
+
+// transcriber serializes the entries of both streams into a Transcript
+type transcriber struct {
+	lok sync.Mutex
+	trn Transcript
+}
+
+func (t *transcriber) writer(s Stream) io.Writer {
+	return transcriptWriter{t: t, s: s}
+}
+
+type transcriptWriter struct {
+	t *transcriber
+	s Stream
+}
+
+func (w transcriptWriter) Write(p []byte) (int, error) {
+	w.t.lok.Lock()
+	defer w.t.lok.Unlock()
+
+	w.t.trn.Record(Entry{Time: time.Now(), Stream: w.s, Data: append([]byte(nil), p...)})
+	return len(p), nil
+}
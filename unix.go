@@ -0,0 +1,111 @@
+//go:build darwin || linux || freebsd || openbsd || netbsd || dragonfly
+// +build darwin linux freebsd openbsd netbsd dragonfly
+
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rlimit - a resource limit, see setrlimit(2)
+type Rlimit = syscall.Rlimit
+
+// credential is the user a command runs as
+type credential = syscall.Credential
+
+// userCredential returns the credential of usr with its groups, unless
+// Options.Groups or Options.NoSetGroups is set
+func (c *CmdIo) userCredential(usr *user.User) (*credential, error) {
+	uid, e := strconv.Atoi(usr.Uid)
+	if e != nil {
+		return nil, fmt.Errorf("invalid uid %q for user %s: %w", usr.Uid, usr.Username, e)
+	}
+	gid, e := strconv.Atoi(usr.Gid)
+	if e != nil {
+		return nil, fmt.Errorf("invalid gid %q for user %s: %w", usr.Gid, usr.Username, e)
+	}
+
+	cred := &credential{
+		Uid:         uint32(uid),
+		Gid:         uint32(gid),
+		Groups:      c.opt.Groups,
+		NoSetGroups: c.opt.NoSetGroups,
+	}
+	if cred.Groups != nil || cred.NoSetGroups || c.self(cred) {
+		return cred, nil
+	}
+
+	ids, e := usr.GroupIds()
+	if e != nil {
+		return nil, fmt.Errorf("groups of user %s: %w", usr.Username, e)
+	}
+	for _, id := range ids {
+		g, e := strconv.ParseUint(id, 10, 32)
+		if e != nil {
+			return nil, fmt.Errorf("invalid group %q for user %s: %w", id, usr.Username, e)
+		}
+		cred.Groups = append(cred.Groups, uint32(g))
+	}
+	return cred, nil
+}
+
+// kill sends sig to pid, or to the process group -pid
+func kill(pid int, sig syscall.Signal) error {
+	return unix.Kill(pid, sig)
+}
+
+func getpgrp() int {
+	return unix.Getpgrp()
+}
+
+func getpgid(pid int) (int, error) {
+	return unix.Getpgid(pid)
+}
+
+func setUmask(mask int) int {
+	return unix.Umask(mask)
+}
+
+func setNice(pid, nice int) error {
+	return unix.Setpriority(unix.PRIO_PROCESS, pid, nice)
+}
+
+// attach and release are the job object of a command on windows
+func attach(pid int, opt *Options) error {
+	return nil
+}
+
+func release(pid int) {}
+
+// rusage returns the cpu times and the peak resident set size in bytes of
+// an exited process
+func rusage(ps *os.ProcessState) (user, sys time.Duration, maxRSS int64) {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return 0, 0, 0
+	}
+	return time.Duration(ru.Utime.Nano()), time.Duration(ru.Stime.Nano()), int64(ru.Maxrss) * maxRSSUnit
+}
@@ -0,0 +1,26 @@
+//go:build openbsd || netbsd || dragonfly
+// +build openbsd netbsd dragonfly
+
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+// children is not known here, the commands are signaled through their
+// process group only
+func children(ppid int) ([]int, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,419 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// There are no signals on windows. Terminate and Kill end the command and
+// what it started with TerminateProcess and exit code 1, Signaled and
+// Killed still report that cmdio ended it while Info.Signal stays 0 and
+// Info.Exit is the exit code. Each command is assigned to a job object
+// that kills what it leaves running once it exits or this process dies.
+
+const (
+	stillActive           = 259
+	errorInvalidParameter = syscall.Errno(87)
+
+	processSetQuota                = 0x0100
+	processQueryLimitedInformation = 0x1000
+
+	jobObjectExtendedLimitInfoClass = 9
+	jobObjectLimitBreakawayOk       = 0x0800
+	jobObjectLimitKillOnJobClose    = 0x2000
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+	procGenerateConsoleCtrlEvent = kernel32.NewProc("GenerateConsoleCtrlEvent")
+)
+
+type jobObjectBasicLimitInformation struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+}
+
+type ioCounters struct {
+	ReadOperationCount  uint64
+	WriteOperationCount uint64
+	OtherOperationCount uint64
+	ReadTransferCount   uint64
+	WriteTransferCount  uint64
+	OtherTransferCount  uint64
+}
+
+type jobObjectExtendedLimitInformation struct {
+	BasicLimitInformation jobObjectBasicLimitInformation
+	IoInfo                ioCounters
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// jobs holds the job object of each running command by pid
+var jobs sync.Map
+
+// Rlimit - a resource limit, Options.Rlimits is not supported on windows
+type Rlimit struct {
+	Cur uint64
+	Max uint64
+}
+
+// credential is the user a command runs as, commands always run as the
+// user of this process on windows
+type credential struct {
+	Uid uint32
+	Gid uint32
+}
+
+func (c *CmdIo) userCredential(usr *user.User) (*credential, error) {
+	return nil, nil
+}
+
+func syscallAttrs(cred *credential, opt *Options) *syscall.SysProcAttr {
+	attrs := &syscall.SysProcAttr{}
+	if opt.ProcessGroup != Inherit {
+		attrs.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+	}
+	return attrs
+}
+
+// supported rejects the options that are not supported on windows
+func supported(opt *Options) error {
+	if opt.Username != "" {
+		return fmt.Errorf("Username: %w", ErrUnsupported)
+	}
+	if opt.Usr != nil {
+		cur, e := user.Current()
+		if e != nil || cur.Uid != opt.Usr.Uid {
+			return fmt.Errorf("Usr: %w", ErrUnsupported)
+		}
+	}
+	for name, set := range map[string]bool{
+		"Groups":      opt.Groups != nil || opt.NoSetGroups,
+		"Chroot":      opt.Chroot != "",
+		"Umask":       opt.Umask != nil,
+		"Nice":        opt.Nice != 0,
+		"Rlimits":     len(opt.Rlimits) > 0,
+		"ExtraFiles":  len(opt.ExtraFiles) > 0 || len(opt.NamedFiles) > 0,
+		"DeathSignal": opt.DeathSignal != 0,
+		"CPUSet":      len(opt.CPUSet) > 0,
+		"OOMScoreAdj": opt.OOMScoreAdj != nil,
+		"Unshare":     opt.Unshare != (Unshare{}),
+		"CgroupPath":  opt.CgroupPath != "",
+		"AmbientCaps": len(opt.AmbientCaps) > 0,
+		"DropCaps":    len(opt.DropCaps) > 0,
+		"NoNewPrivs":  opt.NoNewPrivs,
+	} {
+		if set {
+			return fmt.Errorf("%s: %w", name, ErrUnsupported)
+		}
+	}
+	return nil
+}
+
+func openProcess(access uint32, pid int) (syscall.Handle, error) {
+	h, e := syscall.OpenProcess(access, false, uint32(pid))
+	if e == errorInvalidParameter {
+		// no such process
+		return 0, syscall.ESRCH
+	}
+	return h, e
+}
+
+// kill ends pid, or pid and what it started when pid is negative, sig 0
+// checks that the process is running
+func kill(pid int, sig syscall.Signal) error {
+	tree := pid < 0
+	if tree {
+		pid = -pid
+	}
+	if sig == 0 {
+		h, e := openProcess(processQueryLimitedInformation, pid)
+		if e != nil {
+			return e
+		}
+		defer syscall.CloseHandle(h)
+		var code uint32
+		if e := syscall.GetExitCodeProcess(h, &code); e != nil {
+			return e
+		}
+		if code != stillActive {
+			return syscall.ESRCH
+		}
+		return nil
+	}
+
+	if tree {
+		if job, ok := jobs.Load(pid); ok {
+			_, _, _ = procTerminateJobObject.Call(uintptr(job.(syscall.Handle)), 1)
+		}
+		killChildren(pid, sig)
+	}
+	h, e := openProcess(syscall.PROCESS_TERMINATE, pid)
+	if e != nil {
+		return e
+	}
+	defer syscall.CloseHandle(h)
+	return syscall.TerminateProcess(h, 1)
+}
+
+// processes returns the parent of every process
+func processes() (map[int]int, error) {
+	snap, e := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if e != nil {
+		return nil, e
+	}
+	defer syscall.CloseHandle(snap)
+
+	parents := make(map[int]int)
+	entry := syscall.ProcessEntry32{}
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	for e = syscall.Process32First(snap, &entry); e == nil; e = syscall.Process32Next(snap, &entry) {
+		parents[int(entry.ProcessID)] = int(entry.ParentProcessID)
+	}
+	return parents, nil
+}
+
+func children(ppid int) ([]int, error) {
+	parents, e := processes()
+	if e != nil {
+		return nil, e
+	}
+	var pids []int
+	for pid, parent := range parents {
+		if parent == ppid && pid != ppid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// killChildren ends every process started by ppid and what they started
+func killChildren(ppid int, s syscall.Signal) {
+	ch, e := children(ppid)
+	if e != nil {
+		return
+	}
+	for _, pid := range ch {
+		if _, ok := detached.Load(pid); ok {
+			continue
+		}
+		killChildren(pid, s)
+		if h, e := openProcess(syscall.PROCESS_TERMINATE, pid); e == nil {
+			_ = syscall.TerminateProcess(h, 1)
+			_ = syscall.CloseHandle(h)
+		}
+	}
+}
+
+// attach assigns pid to a new job object, what the command starts from
+// then on is in the job unless it breaks away
+func attach(pid int, opt *Options) error {
+	if opt.Detach {
+		return nil
+	}
+	job, _, e := procCreateJobObjectW.Call(0, 0)
+	if job == 0 {
+		return fmt.Errorf("job object: %w", e)
+	}
+	info := jobObjectExtendedLimitInformation{}
+	info.BasicLimitInformation.LimitFlags = jobObjectLimitKillOnJobClose | jobObjectLimitBreakawayOk
+	if r, _, e := procSetInformationJobObject.Call(job, jobObjectExtendedLimitInfoClass,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); r == 0 {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return fmt.Errorf("job object: %w", e)
+	}
+
+	h, err := openProcess(processSetQuota|syscall.PROCESS_TERMINATE, pid)
+	if err != nil {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return fmt.Errorf("job object: %w", err)
+	}
+	defer syscall.CloseHandle(h)
+	if r, _, e := procAssignProcessToJobObject.Call(job, uintptr(h)); r == 0 {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return fmt.Errorf("job object: %w", e)
+	}
+	jobs.Store(pid, syscall.Handle(job))
+	return nil
+}
+
+// release closes the job object of pid once it exited, which kills what
+// it left running
+func release(pid int) {
+	if job, ok := jobs.LoadAndDelete(pid); ok {
+		_ = syscall.CloseHandle(job.(syscall.Handle))
+	}
+}
+
+func getpgrp() int {
+	return os.Getpid()
+}
+
+func getpgid(pid int) (int, error) {
+	return pid, nil
+}
+
+func setUmask(mask int) int {
+	return 0
+}
+
+func setNice(pid, nice int) error {
+	return ErrUnsupported
+}
+
+func filetime(ft syscall.Filetime) time.Duration {
+	return time.Duration(uint64(ft.HighDateTime)<<32|uint64(ft.LowDateTime)) * 100
+}
+
+func processTimes(pid int) (creation, kernel, user syscall.Filetime, e error) {
+	h, e := openProcess(processQueryLimitedInformation, pid)
+	if e != nil {
+		return
+	}
+	defer syscall.CloseHandle(h)
+	var exit syscall.Filetime
+	e = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user)
+	return
+}
+
+func procStart(pid int) (time.Time, error) {
+	creation, _, _, e := processTimes(pid)
+	if e != nil {
+		return time.Time{}, e
+	}
+	return time.Unix(0, creation.Nanoseconds()), nil
+}
+
+// procCPU returns the user and kernel time of pid
+func procCPU(pid int) (time.Duration, error) {
+	_, kernel, user, e := processTimes(pid)
+	if e != nil {
+		return 0, e
+	}
+	return filetime(kernel) + filetime(user), nil
+}
+
+// rusage returns the cpu times of an exited process, windows reports no
+// peak resident set size once it has exited
+func rusage(ps *os.ProcessState) (user, sys time.Duration, maxRSS int64) {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return 0, 0, 0
+	}
+	return filetime(ru.UserTime), filetime(ru.KernelTime), 0
+}
+
+func startLimited(cmd *exec.Cmd, limits map[int]Rlimit) error {
+	return ErrUnsupported
+}
+
+func confine(opt *Options) error {
+	return nil
+}
+
+// waitIO - the storage io of a command is reported on linux only
+func waitIO(pid int) (read, write int64) {
+	return 0, 0
+}
+
+func setAffinity(pid int, cpus []int) error {
+	return ErrUnsupported
+}
+
+func setOOMScoreAdj(pid, adj int) error {
+	return ErrUnsupported
+}
+
+// cgroup is linux only
+type cgroup struct {
+	dir string
+}
+
+func newCgroup(opt *Options) (*cgroup, error) {
+	return nil, ErrUnsupported
+}
+
+func (cg *cgroup) attrs(attrs *syscall.SysProcAttr) {}
+func (cg *cgroup) closeFD()                         {}
+func (cg *cgroup) signal(sig syscall.Signal)        {}
+func (cg *cgroup) kill()                            {}
+func (cg *cgroup) remove() error                    { return nil }
+
+// signals receives the interrupts of this process while the handler is
+// installed
+var signals = make(chan os.Signal, 1)
+
+// startSignalHandler installs the handler, it is called once for all the
+// commands this process manages
+func startSignalHandler() {
+	signal.Notify(signals, os.Interrupt)
+	go signalHandler()
+}
+
+// stopSignalHandler restores the default handling of interrupts and ends
+// signalHandler
+func stopSignalHandler() {
+	signal.Stop(signals)
+	close(signals)
+}
+
+// signalHandler ends the children of this process on an interrupt, then
+// raises it again
+func signalHandler() {
+	for range signals {
+		forward(syscall.SIGINT)
+		raise()
+	}
+}
+
+// ctrlCEvent is CTRL_C_EVENT
+const ctrlCEvent = 0
+
+// raise stops handling interrupts and generates a Ctrl-C on the console of
+// this process, which then ends as it would without the handler. An
+// application that handles interrupts itself receives it a second time,
+// commands in a process group of their own do not receive it
+func raise() {
+	signal.Stop(signals)
+	_, _, _ = procGenerateConsoleCtrlEvent.Call(ctrlCEvent, 0)
+}
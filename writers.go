@@ -0,0 +1,248 @@
+/*
+Copyright © 2020 streamz <bytecodenerd@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdio
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// epoch - the monotonic reference of the times kept as int64
+var epoch = time.Now()
+
+// activityWriter records the time of the last write in nanos since epoch
+type activityWriter struct {
+	w   io.Writer
+	act *int64
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(a.act, int64(time.Since(epoch)))
+	return a.w.Write(p)
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w   io.Writer
+	cnt *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, e := c.w.Write(p)
+	atomic.AddInt64(c.cnt, int64(n))
+	return n, e
+}
+
+// counted counts the bytes written to w in cnt, a file is left alone so
+// that the command writes to it directly instead of through a pipe that
+// cmdio copies from, a terminal stays a terminal
+func counted(w io.Writer, cnt *int64) io.Writer {
+	if _, ok := w.(*os.File); ok || w == nil {
+		return w
+	}
+	return &countingWriter{w: w, cnt: cnt}
+}
+
+// limitWriter drops everything written to w after n bytes, calling hit
+// once when it starts dropping, in line mode the cut is made after the
+// last complete line
+type limitWriter struct {
+	w     io.Writer
+	n     int64
+	lines bool
+	hit   func()
+	done  bool
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.done {
+		return len(p), nil
+	}
+
+	b := p
+	if int64(len(b)) > l.n {
+		b = b[:l.n]
+		if l.lines {
+			b = b[:bytes.LastIndexByte(b, '\n')+1]
+		}
+		l.done = true
+		defer l.hit()
+	}
+	l.n -= int64(len(b))
+	if len(b) > 0 {
+		if _, e := l.w.Write(b); e != nil {
+			return 0, e
+		}
+	}
+	return len(p), nil
+}
+
+// isolatedWriter stops writing to w after its first failure, reporting
+// the error once instead of failing the writes of the command
+type isolatedWriter struct {
+	w    io.Writer
+	fail func(error)
+	err  error
+}
+
+func (i *isolatedWriter) Write(p []byte) (int, error) {
+	if i.err == nil {
+		if _, i.err = i.w.Write(p); i.err != nil {
+			i.fail(i.err)
+		}
+	}
+	return len(p), nil
+}
+
+// decoratedWriter inserts the bytes returned by deco at the start of every
+// line, partial lines are passed through as they arrive and a carriage
+// return does not start a new line. With split the output is buffered and
+// decorated at the start of every token instead
+type decoratedWriter struct {
+	w     io.Writer
+	deco  func() []byte
+	mid   bool
+	split bufio.SplitFunc
+	buf   []byte
+}
+
+func (d *decoratedWriter) Write(p []byte) (int, error) {
+	if d.split != nil {
+		d.buf = append(d.buf, p...)
+		if e := d.scan(false); e != nil {
+			return 0, e
+		}
+		return len(p), nil
+	}
+	out := make([]byte, 0, len(p)+64)
+	for b := p; len(b) > 0; {
+		if !d.mid {
+			out = append(out, d.deco()...)
+			d.mid = true
+		}
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			out = append(out, b...)
+			break
+		}
+		out = append(out, b[:i+1]...)
+		b = b[i+1:]
+		d.mid = false
+	}
+	if _, e := d.w.Write(out); e != nil {
+		return 0, e
+	}
+	return len(p), nil
+}
+
+// scan writes the buffered tokens, the delimiters are kept
+func (d *decoratedWriter) scan(eof bool) error {
+	var out []byte
+	for len(d.buf) > 0 {
+		adv, _, e := d.split(d.buf, eof)
+		if adv > len(d.buf) {
+			adv = len(d.buf)
+		}
+		if adv == 0 {
+			break
+		}
+		out = append(append(out, d.deco()...), d.buf[:adv]...)
+		d.buf = d.buf[adv:]
+		if e != nil {
+			break
+		}
+	}
+	if eof && len(d.buf) > 0 {
+		out = append(append(out, d.deco()...), d.buf...)
+		d.buf = nil
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	_, e := d.w.Write(out)
+	return e
+}
+
+func (d *decoratedWriter) flush() {
+	if d.split != nil {
+		_ = d.scan(true)
+	}
+}
+
+// flusher is a writer holding output until it is flushed
+type flusher interface {
+	flush()
+}
+
+// flushOnExit flushes f once the current attempt exits
+func (c *CmdIo) flushOnExit(f flusher) {
+	c.lok.Lock()
+	c.fls = append(c.fls, f)
+	c.lok.Unlock()
+}
+
+// flushWriters flushes the writers of the current attempt, the outermost
+// writer first
+func (c *CmdIo) flushWriters() {
+	c.lok.Lock()
+	fls := c.fls
+	c.fls = nil
+	c.lok.Unlock()
+
+	for i := len(fls) - 1; i >= 0; i-- {
+		fls[i].flush()
+	}
+}
+
+// decorated splits the decorations of w with Options.SplitFunc
+func (c *CmdIo) decorated(w io.Writer) io.Writer {
+	if d, ok := w.(*decoratedWriter); ok && c.opt.SplitFunc != nil {
+		d.split = c.opt.SplitFunc
+		c.flushOnExit(d)
+	}
+	return w
+}
+
+// prefixed decorates every line written to w with prefix, colored with the
+// ANSI SGR code color when it is not zero
+func prefixed(w io.Writer, prefix string, color int) io.Writer {
+	if prefix == "" || w == nil {
+		return w
+	}
+	pre := []byte(prefix)
+	if color != 0 {
+		pre = []byte(fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, prefix))
+	}
+	return &decoratedWriter{w: w, deco: func() []byte { return pre }}
+}
+
+// stamped decorates every line written to w with the current time, stamps
+// are only inserted after a newline so multi-byte UTF-8 sequences are
+// never split
+func stamped(w io.Writer, layout string) io.Writer {
+	if layout == "" {
+		layout = time.RFC3339Nano
+	}
+	return &decoratedWriter{w: w, deco: func() []byte {
+		return []byte(time.Now().Format(layout) + " ")
+	}}
+}